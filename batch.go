@@ -0,0 +1,161 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package syncutil
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// ErrNoValue is returned by BatchGroup.Load for a key whose batch returned
+// neither a value nor an error for it.
+var ErrNoValue = errors.New("syncutil: batch returned no value for key")
+
+// BatchErrors is an error that a BatchGroup's function may return to fail
+// some keys of a batch: each key in the map receives its error, and the
+// other keys their values.
+type BatchErrors[K comparable] map[K]error
+
+func (e BatchErrors[K]) Error() string {
+	if len(e) == 1 {
+		for k, err := range e {
+			return fmt.Sprintf("syncutil: batch failed for key %v: %v", k, err)
+		}
+	}
+	return fmt.Sprintf("syncutil: batch failed for %d keys", len(e))
+}
+
+// A BatchGroup is like Map, but it coalesces the keys requested by
+// concurrent calls to Load within a short window into a single call to its
+// function, in the manner of a dataloader. Values are memoized per key, and
+// a key that is memoized or already part of a batch in flight is not
+// requested again.
+type BatchGroup[K comparable, V any] struct {
+	noCopy noCopy
+
+	fn  func(ctx context.Context, keys []K) (map[K]V, error)
+	cfg config
+	t   table[K]
+
+	mu    sync.Mutex
+	batch *batch[K, V] // batch being collected; guarded by mu
+}
+
+// A batch is the set of keys for a single call to a BatchGroup's function.
+type batch[K comparable, V any] struct {
+	ctx   context.Context
+	keys  []K
+	timer *time.Timer
+	done  chan struct{} // closed once vals and err are set
+	vals  map[K]V
+	err   error
+}
+
+// NewBatchGroup returns a BatchGroup that loads the values of keys with fn,
+// whose entries are configured with the given options, as with New. The
+// value of a key that is missing from the map returned by fn is ErrNoValue,
+// unless fn returned an error: a BatchErrors fails its own keys, and any
+// other error fails every key of the batch. Failed keys are not memoized,
+// unless the options say so.
+//
+// Use WithBatchWindow and WithMaxBatchSize to bound the batches.
+func NewBatchGroup[K comparable, V any](fn func(ctx context.Context, keys []K) (map[K]V, error), opts ...Option) *BatchGroup[K, V] {
+	b := &BatchGroup[K, V]{fn: fn}
+	b.cfg.batchWindow = time.Millisecond
+	b.cfg.apply(opts)
+	return b
+}
+
+// Load returns the value of key, loading it in a batch if necessary. As with
+// Init.Do, ctx only bounds the caller's own wait.
+func (b *BatchGroup[K, V]) Load(ctx context.Context, key K) (V, error) {
+	v, err := b.t.get(&b.cfg, key).DoContext(ctx, func(ctx context.Context) (interface{}, error) {
+		return b.load(ctx, key)
+	})
+	if err != nil {
+		var zero V
+		return zero, err
+	}
+	val, _ := v.(V) // a nil interface value is the zero V
+	return val, nil
+}
+
+// Forget drops the entry of key, like Group.Forget.
+func (b *BatchGroup[K, V]) Forget(key K) {
+	if i := b.t.remove(&b.cfg, key); i != nil {
+		i.drop()
+	}
+}
+
+// load adds key to the batch being collected and returns its results once
+// the batch is done. It is called by the run of key's Init.
+func (b *BatchGroup[K, V]) load(ctx context.Context, key K) (interface{}, error) {
+	b.mu.Lock()
+	bt := b.batch
+	if bt == nil {
+		// The batch outlives the run that starts it.
+		bt = &batch[K, V]{ctx: context.WithoutCancel(ctx), done: make(chan struct{})}
+		bt.timer = time.AfterFunc(b.cfg.batchWindow, func() { b.dispatch(bt, true) })
+		b.batch = bt
+	}
+	bt.keys = append(bt.keys, key)
+	if n := b.cfg.maxBatchSize; n > 0 && len(bt.keys) >= n {
+		go b.dispatch(bt, false)
+		b.batch = nil
+	}
+	b.mu.Unlock()
+
+	select {
+	case <-bt.done:
+	case <-ctx.Done(): // the run gave up, and the batch goes on without key
+		return nil, context.Cause(ctx)
+	}
+	var errs BatchErrors[K]
+	switch {
+	case bt.err == nil:
+	case errors.As(bt.err, &errs):
+		if err := errs[key]; err != nil {
+			return nil, err
+		}
+	default:
+		return nil, bt.err
+	}
+	val, ok := bt.vals[key]
+	if !ok {
+		return nil, ErrNoValue
+	}
+	return val, nil
+}
+
+// dispatch calls b.fn with the keys of bt. When the window of bt expires, it
+// is first detached from b, unless it is already full and dispatched. As with
+// the calls of an Init, a panic in b.fn is recovered only with WithRecover or
+// WithIsolatedRun, and it fails every key of bt.
+func (b *BatchGroup[K, V]) dispatch(bt *batch[K, V], expired bool) {
+	if expired {
+		b.mu.Lock()
+		if b.batch != bt {
+			b.mu.Unlock()
+			return
+		}
+		b.batch = nil
+		b.mu.Unlock()
+	} else {
+		bt.timer.Stop()
+	}
+	defer close(bt.done)
+	if b.cfg.recover {
+		defer func() {
+			if r := recover(); r != nil {
+				bt.vals, bt.err = nil, &PanicError{Value: r, Stack: debug.Stack()}
+			}
+		}()
+	}
+	bt.vals, bt.err = b.fn(bt.ctx, bt.keys)
+}
@@ -0,0 +1,153 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package syncutil
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBatchGroup(t *testing.T) {
+	var mu sync.Mutex
+	var batches [][]int
+	notFound := errors.New("not found")
+	fail := errors.New("fail")
+	b := NewBatchGroup(func(ctx context.Context, keys []int) (map[int]int, error) {
+		mu.Lock()
+		batches = append(batches, append([]int(nil), keys...))
+		mu.Unlock()
+		vals := make(map[int]int)
+		errs := make(BatchErrors[int])
+		for _, k := range keys {
+			switch {
+			case k < 0:
+				return nil, fail
+			case k == 13:
+				errs[k] = notFound
+			case k != 7:
+				vals[k] = k * k
+			}
+		}
+		if len(errs) > 0 {
+			return vals, errs
+		}
+		return vals, nil
+	}, WithBatchWindow(20*time.Millisecond))
+	ctx := context.Background()
+
+	type result struct {
+		key, val int
+		err      error
+	}
+	keys := []int{1, 2, 3, 1, 2, 7, 13}
+	ch := make(chan result, len(keys))
+	for _, k := range keys {
+		go func(k int) {
+			v, err := b.Load(ctx, k)
+			ch <- result{k, v, err}
+		}(k)
+	}
+	for range keys {
+		r := <-ch
+		var want result
+		switch r.key {
+		case 7:
+			want = result{7, 0, ErrNoValue}
+		case 13:
+			want = result{13, 0, notFound}
+		default:
+			want = result{r.key, r.key * r.key, nil}
+		}
+		if r != want {
+			t.Fatalf("got: %+v; want: %+v", r, want)
+		}
+	}
+	mu.Lock()
+	if len(batches) != 1 {
+		t.Fatalf("got batches: %v; want: 1 batch", batches)
+	}
+	sort.Ints(batches[0])
+	if want := []int{1, 2, 3, 7, 13}; !reflect.DeepEqual(batches[0], want) {
+		t.Fatalf("got keys: %v; want: %v", batches[0], want)
+	}
+	batches = nil
+	mu.Unlock()
+
+	// Memoized keys are not requested again; failed ones are.
+	for _, k := range []int{1, 13, -1} {
+		v, err := b.Load(ctx, k)
+		switch {
+		case k == 1 && (v != 1 || err != nil):
+			t.Fatalf("memoized: got: (%v, %v); want: (1, <nil>)", v, err)
+		case k == 13 && err != notFound:
+			t.Fatalf("failed key: got error: %v; want: %v", err, notFound)
+		case k == -1 && err != fail:
+			t.Fatalf("failed batch: got error: %v; want: %v", err, fail)
+		}
+	}
+	mu.Lock()
+	if want := [][]int{{13}, {-1}}; !reflect.DeepEqual(batches, want) {
+		t.Fatalf("got batches: %v; want: %v", batches, want)
+	}
+	mu.Unlock()
+}
+
+func TestBatchGroupMaxBatchSize(t *testing.T) {
+	sizes := make(chan int, 10)
+	b := NewBatchGroup(func(ctx context.Context, keys []string) (map[string]bool, error) {
+		sizes <- len(keys)
+		vals := make(map[string]bool)
+		for _, k := range keys {
+			vals[k] = true
+		}
+		return vals, nil
+	}, WithBatchWindow(time.Hour), WithMaxBatchSize(2))
+	ctx := context.Background()
+	errc := make(chan error, 2)
+	for _, k := range []string{"a", "b"} {
+		go func(k string) {
+			_, err := b.Load(ctx, k)
+			errc <- err
+		}(k)
+	}
+	for k := 0; k < 2; k++ {
+		if err := <-errc; err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+	}
+	if n := <-sizes; n != 2 {
+		t.Fatalf("got batch of %d keys; want: 2", n)
+	}
+}
+
+func TestBatchGroupPanic(t *testing.T) {
+	b := NewBatchGroup(func(ctx context.Context, keys []int) (map[int]int, error) {
+		panic("boom")
+	}, WithRecover())
+	_, err := b.Load(context.Background(), 1)
+	var perr *PanicError
+	if !errors.As(err, &perr) || perr.Value != "boom" {
+		t.Fatalf("got error: %v; want: PanicError(boom)", err)
+	}
+}
+
+func TestBatchGroupRunTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	b := NewBatchGroup(func(ctx context.Context, keys []int) (map[int]int, error) {
+		<-release
+		return nil, nil
+	}, WithRunTimeout(10*time.Millisecond), WithLeakTracking())
+	if _, err := b.Load(context.Background(), 1); err != ErrRunTimeout {
+		t.Fatalf("got error: %v; want: %v", err, ErrRunTimeout)
+	}
+	// The call for the key returns without waiting for its batch.
+	waitLeakedRuns(t, b.t.lookup(&b.cfg, 1), 0)
+}
@@ -0,0 +1,74 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package syncutil
+
+import "context"
+
+// A Backend stores the values of a Cache, such as a Redis or memcached
+// client. Its methods must be safe to call concurrently.
+type Backend[V any] interface {
+	// Get returns the value of key and true, or false if there is none.
+	Get(ctx context.Context, key string) (val V, ok bool, err error)
+	// Set stores the value of key.
+	Set(ctx context.Context, key string, val V) error
+	// Delete deletes the value of key, if any.
+	Delete(ctx context.Context, key string) error
+}
+
+// A Cache is a read-through cache whose values live in a Backend. Like
+// Group, it de-duplicates concurrent calls with the same key, so that a
+// single load per key is in flight in this process, but it does not memoize
+// values itself: once a load is over, the next call for its key asks the
+// Backend again.
+type Cache[V any] struct {
+	noCopy noCopy
+
+	backend Backend[V]
+	cfg     config
+	t       table[string]
+}
+
+// NewCache returns a Cache backed by b whose loads are configured with the
+// given options, as with New.
+func NewCache[V any](b Backend[V], opts ...Option) *Cache[V] {
+	c := &Cache[V]{backend: b}
+	c.cfg.apply(opts)
+	return c
+}
+
+// Get returns the value of key from the Backend or, if it has none, calls fn
+// to load it and stores it in the Backend. Concurrent calls for key share a
+// single load, as with Init.DoContext. A failure to store the value is
+// logged, but does not fail the call.
+func (c *Cache[V]) Get(ctx context.Context, key string, fn func(ctx context.Context) (V, error)) (V, error) {
+	i := c.t.get(&c.cfg, key)
+	v, err := i.DoContext(ctx, func(ctx context.Context) (interface{}, error) {
+		// Once the load is over, later calls ask the Backend again.
+		defer c.t.removeIf(&c.cfg, key, i)
+		val, ok, err := c.backend.Get(ctx, key)
+		if err != nil || ok {
+			return val, err
+		}
+		if val, err = fn(ctx); err != nil {
+			return nil, err
+		}
+		if err := c.backend.Set(ctx, key, val); err != nil {
+			i.logf("cache set failed for key %q: %v", key, err)
+		}
+		return val, nil
+	})
+	if err != nil {
+		var zero V
+		return zero, err
+	}
+	val, _ := v.(V) // a nil interface value is the zero V
+	return val, nil
+}
+
+// Delete deletes the value of key from the Backend. A load of key in flight
+// is not affected.
+func (c *Cache[V]) Delete(ctx context.Context, key string) error {
+	return c.backend.Delete(ctx, key)
+}
@@ -0,0 +1,109 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package syncutil
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// mapBackend is a Backend that stores values in a map.
+type mapBackend struct {
+	mu   sync.Mutex
+	m    map[string]string
+	gets int
+	err  error // returned by Set
+}
+
+func (b *mapBackend) Get(ctx context.Context, key string) (string, bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.gets++
+	val, ok := b.m[key]
+	return val, ok, nil
+}
+
+func (b *mapBackend) Set(ctx context.Context, key string, val string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err != nil {
+		return b.err
+	}
+	if b.m == nil {
+		b.m = make(map[string]string)
+	}
+	b.m[key] = val
+	return nil
+}
+
+func (b *mapBackend) Delete(ctx context.Context, key string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.m, key)
+	return nil
+}
+
+func TestCache(t *testing.T) {
+	const N = 10
+	b := new(mapBackend)
+	c := NewCache[string](b)
+	ctx := context.Background()
+	var loads uint32
+	load := func(ctx context.Context) (string, error) {
+		atomic.AddUint32(&loads, 1)
+		time.Sleep(10 * time.Millisecond)
+		return "A", nil
+	}
+	errc := make(chan error, N)
+	for k := 0; k < N; k++ {
+		go func() {
+			val, err := c.Get(ctx, "a", load)
+			if err == nil && val != "A" {
+				t.Errorf("got: %q; want: A", val)
+			}
+			errc <- err
+		}()
+	}
+	for k := 0; k < N; k++ {
+		if err := <-errc; err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+	}
+	if n := atomic.LoadUint32(&loads); n != 1 {
+		t.Fatalf("loaded %d times; want: 1", n)
+	}
+
+	// Later calls are served by the backend, not memoized.
+	b.mu.Lock()
+	b.m["a"] = "B"
+	gets := b.gets
+	b.mu.Unlock()
+	if val, err := c.Get(ctx, "a", load); val != "B" || err != nil {
+		t.Fatalf("backend: got: (%q, %v); want: (B, <nil>)", val, err)
+	}
+	if b.gets != gets+1 {
+		t.Fatalf("got %d gets; want: %d", b.gets, gets+1)
+	}
+
+	if err := c.Delete(ctx, "a"); err != nil {
+		t.Fatalf("Delete: got error: %v", err)
+	}
+	b.err = errors.New("backend down")
+	if val, err := c.Get(ctx, "a", load); val != "A" || err != nil {
+		t.Fatalf("after Delete: got: (%q, %v); want: (A, <nil>)", val, err)
+	}
+	if n := atomic.LoadUint32(&loads); n != 2 {
+		t.Fatalf("loaded %d times; want: 2", n)
+	}
+
+	fail := errors.New("fail")
+	if _, err := c.Get(ctx, "b", func(context.Context) (string, error) { return "", fail }); err != fail {
+		t.Fatalf("failure: got error: %v; want: %v", err, fail)
+	}
+}
@@ -0,0 +1,33 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package syncutil
+
+import "expvar"
+
+// Publish publishes the state of i as an expvar.Var under name, so that it is
+// exported by the /debug/vars handler. The value is a JSON object of the form
+//
+//	{"finished": true, "attempts": 2, "waiters": 0, "last_error": "dial: timeout", "last_duration_ns": 1500000}
+//
+// where last_error is empty if no run has failed. Like expvar.Publish, it
+// panics if name is already registered.
+func (i *Init) Publish(name string) {
+	expvar.Publish(name, expvar.Func(i.expvar))
+}
+
+func (i *Init) expvar() interface{} {
+	s := i.Stats()
+	var lastErr string
+	if s.LastErr != nil {
+		lastErr = s.LastErr.Error()
+	}
+	return map[string]interface{}{
+		"finished":         s.Finished,
+		"attempts":         s.Attempts,
+		"waiters":          s.Waiters,
+		"last_error":       lastErr,
+		"last_duration_ns": int64(s.LastDuration),
+	}
+}
@@ -0,0 +1,50 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package syncutil
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"sync/atomic"
+	"testing"
+)
+
+var publishes uint32
+
+func TestPublish(t *testing.T) {
+	// Names can't be unpublished, so use a new one each time the test runs.
+	name := fmt.Sprintf("syncutil_test_init_%d", atomic.AddUint32(&publishes, 1))
+	i := new(Init)
+	i.Publish(name)
+	ctx := context.Background()
+	fail := errors.New("fail")
+	if _, err := i.Do(ctx, func() (interface{}, error) { return nil, fail }); err != fail {
+		t.Fatalf("failure: got error: %v; want: %v", err, fail)
+	}
+	if _, err := i.Do(ctx, func() (interface{}, error) { return "ok", nil }); err != nil {
+		t.Fatalf("success: got error: %v", err)
+	}
+
+	var got struct {
+		Finished     bool   `json:"finished"`
+		Attempts     uint64 `json:"attempts"`
+		Waiters      int    `json:"waiters"`
+		LastError    string `json:"last_error"`
+		LastDuration int64  `json:"last_duration_ns"`
+	}
+	v := expvar.Get(name)
+	if v == nil {
+		t.Fatal("var not published")
+	}
+	if err := json.Unmarshal([]byte(v.String()), &got); err != nil {
+		t.Fatalf("unmarshal %s: %v", v, err)
+	}
+	if !got.Finished || got.Attempts != 2 || got.Waiters != 0 || got.LastError != "fail" || got.LastDuration < 0 {
+		t.Fatalf("got: %s; want finished after 2 attempts with last error fail", v)
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package syncutil
+
+import (
+	"context"
+	"errors"
+)
+
+// A Future holds the results of a function started by Go, for callers to
+// join later. Unlike Init, the function runs once and right away: its
+// results are final, whether or not they are an error.
+type Future[T any] struct {
+	done   chan struct{} // closed once val and err are set
+	val    T
+	err    error
+	cancel context.CancelCauseFunc
+}
+
+// Go calls fn in a new goroutine with a context derived from ctx and returns
+// a Future of its results. Canceling ctx, or calling Cancel, is up to fn to
+// observe.
+func Go[T any](ctx context.Context, fn func(ctx context.Context) (T, error)) *Future[T] {
+	ctx, cancel := context.WithCancelCause(ctx)
+	f := &Future[T]{done: make(chan struct{}), cancel: cancel}
+	go func() {
+		defer cancel(nil)
+		f.val, f.err = fn(ctx)
+		close(f.done)
+	}()
+	return f
+}
+
+// Cancel cancels the context of the function of f with cause, as with a
+// context.CancelCauseFunc. A nil cause means context.Canceled. It has no
+// effect once the function has returned.
+func (f *Future[T]) Cancel(cause error) {
+	f.cancel(cause)
+}
+
+// Result waits for the results of f and returns them. If ctx is done
+// first, it returns the cause of ctx, as reported by context.Cause; the
+// function keeps running and its results remain available. As with
+// Init.Do, results that are ready take precedence over ctx.
+func (f *Future[T]) Result(ctx context.Context) (T, error) {
+	select {
+	case <-f.done:
+		return f.val, f.err
+	default:
+	}
+	select {
+	case <-f.done:
+		return f.val, f.err
+	case <-ctx.Done():
+		var zero T
+		return zero, context.Cause(ctx)
+	}
+}
+
+// Done returns a channel that is closed once the results of f are ready.
+func (f *Future[T]) Done() <-chan struct{} {
+	return f.done
+}
+
+// TryResult returns the results of f and true, without blocking, or false if
+// they are not ready.
+func (f *Future[T]) TryResult() (T, error, bool) {
+	select {
+	case <-f.done:
+		return f.val, f.err, true
+	default:
+		var zero T
+		return zero, nil, false
+	}
+}
+
+// errNoFutures is returned by Any and Race when they are given no futures.
+var errNoFutures = errors.New("syncutil: no futures")
+
+// All waits for the results of every future in fs and returns their values,
+// in the order of fs. If any of them fails, it also returns their errors,
+// joined by errors.Join. If ctx is done first, it returns the cause of ctx;
+// the futures are not canceled.
+func All[T any](ctx context.Context, fs ...*Future[T]) ([]T, error) {
+	vals := make([]T, len(fs))
+	var errs []error
+	for k, f := range fs {
+		if !isClosed(f.done) {
+			select {
+			case <-f.done:
+			case <-ctx.Done():
+				return nil, context.Cause(ctx)
+			}
+		}
+		vals[k] = f.val
+		if f.err != nil {
+			errs = append(errs, f.err)
+		}
+	}
+	return vals, errors.Join(errs...)
+}
+
+// Any returns the value of the first future in fs to succeed, and cancels
+// the others. If they all fail, it returns their errors, joined by
+// errors.Join. If ctx is done first, it returns the cause of ctx; the
+// futures are not canceled.
+func Any[T any](ctx context.Context, fs ...*Future[T]) (T, error) {
+	return first(ctx, fs, false)
+}
+
+// Race returns the results of the first future in fs to complete, whether or
+// not they are an error, and cancels the others. If ctx is done first, it
+// returns the cause of ctx; the futures are not canceled.
+func Race[T any](ctx context.Context, fs ...*Future[T]) (T, error) {
+	return first(ctx, fs, true)
+}
+
+// first returns the results of the first future in fs to complete or, if
+// not anyErr, to succeed, and cancels the others.
+func first[T any](ctx context.Context, fs []*Future[T], anyErr bool) (T, error) {
+	var zero T
+	if len(fs) == 0 {
+		return zero, errNoFutures
+	}
+	ready := make(chan int, len(fs))
+	stop := make(chan struct{})
+	defer close(stop)
+	for k, f := range fs {
+		go func() {
+			select {
+			case <-f.done:
+				ready <- k
+			case <-stop:
+			}
+		}()
+	}
+	var errs []error
+	for range fs {
+		select {
+		case k := <-ready:
+			f := fs[k]
+			if f.err != nil && !anyErr {
+				errs = append(errs, f.err)
+				continue
+			}
+			for _, other := range fs {
+				if other != f {
+					other.Cancel(nil)
+				}
+			}
+			return f.val, f.err
+		case <-ctx.Done():
+			return zero, context.Cause(ctx)
+		}
+	}
+	return zero, errors.Join(errs...)
+}
@@ -0,0 +1,149 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package syncutil
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestFuture(t *testing.T) {
+	ctx := context.Background()
+	release := make(chan struct{})
+	f := Go(ctx, func(ctx context.Context) (string, error) {
+		<-release
+		return "ok", nil
+	})
+	if v, err, ok := f.TryResult(); ok {
+		t.Fatalf("TryResult before done: got: (%v, %v, true); want: false", v, err)
+	}
+	cause := errors.New("gave up")
+	wctx, cancel := context.WithCancelCause(ctx)
+	cancel(cause)
+	if v, err := f.Result(wctx); v != "" || err != cause {
+		t.Fatalf("Result with done ctx: got: (%q, %v); want: (\"\", %v)", v, err, cause)
+	}
+	close(release)
+	<-f.Done()
+	if v, err := f.Result(wctx); v != "ok" || err != nil {
+		t.Fatalf("Result after done: got: (%q, %v); want: (ok, <nil>)", v, err)
+	}
+	if v, err, ok := f.TryResult(); v != "ok" || err != nil || !ok {
+		t.Fatalf("TryResult: got: (%q, %v, %v); want: (ok, <nil>, true)", v, err, ok)
+	}
+
+	// Errors are final.
+	fail := errors.New("fail")
+	e := Go(ctx, func(ctx context.Context) (int, error) { return 0, fail })
+	for k := 0; k < 2; k++ {
+		if _, err := e.Result(ctx); err != fail {
+			t.Fatalf("failure: got error: %v; want: %v", err, fail)
+		}
+	}
+
+	// fn receives ctx.
+	tctx, cancel2 := context.WithTimeout(ctx, time.Millisecond)
+	defer cancel2()
+	c := Go(tctx, func(ctx context.Context) (int, error) {
+		<-ctx.Done()
+		return 0, ctx.Err()
+	})
+	if _, err := c.Result(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("canceled: got error: %v; want: %v", err, context.DeadlineExceeded)
+	}
+}
+
+// sleeper returns a function that returns val, err after d, or the cause of
+// its context if it is canceled first.
+func sleeper[T any](d time.Duration, val T, err error) func(context.Context) (T, error) {
+	return func(ctx context.Context) (T, error) {
+		select {
+		case <-time.After(d):
+			return val, err
+		case <-ctx.Done():
+			var zero T
+			return zero, context.Cause(ctx)
+		}
+	}
+}
+
+func TestAll(t *testing.T) {
+	ctx := context.Background()
+	vals, err := All(ctx,
+		Go(ctx, sleeper(10*time.Millisecond, 1, nil)),
+		Go(ctx, sleeper(0, 2, nil)),
+	)
+	if err != nil || len(vals) != 2 || vals[0] != 1 || vals[1] != 2 {
+		t.Fatalf("got: (%v, %v); want: ([1 2], <nil>)", vals, err)
+	}
+
+	fail1, fail2 := errors.New("fail 1"), errors.New("fail 2")
+	_, err = All(ctx,
+		Go(ctx, sleeper(0, 0, fail1)),
+		Go(ctx, sleeper(0, 1, nil)),
+		Go(ctx, sleeper(0, 0, fail2)),
+	)
+	if !errors.Is(err, fail1) || !errors.Is(err, fail2) {
+		t.Fatalf("failures: got error: %v; want: %v and %v", err, fail1, fail2)
+	}
+
+	slow := Go(ctx, sleeper(time.Hour, 0, nil))
+	defer slow.Cancel(nil)
+	wctx, cancel := context.WithTimeout(ctx, time.Millisecond)
+	defer cancel()
+	if _, err := All(wctx, slow); err != context.DeadlineExceeded {
+		t.Fatalf("ctx done: got error: %v; want: %v", err, context.DeadlineExceeded)
+	}
+	if _, _, ok := slow.TryResult(); ok {
+		t.Fatal("ctx done: future was canceled")
+	}
+}
+
+func TestAny(t *testing.T) {
+	ctx := context.Background()
+	fail := errors.New("fail")
+	loser := Go(ctx, sleeper(time.Hour, 0, nil))
+	v, err := Any(ctx,
+		Go(ctx, sleeper(0, 0, fail)),
+		Go(ctx, sleeper(10*time.Millisecond, 2, nil)),
+		loser,
+	)
+	if v != 2 || err != nil {
+		t.Fatalf("got: (%v, %v); want: (2, <nil>)", v, err)
+	}
+	if _, err := loser.Result(ctx); err != context.Canceled {
+		t.Fatalf("loser: got error: %v; want: %v", err, context.Canceled)
+	}
+
+	_, err = Any(ctx, Go(ctx, sleeper(0, 0, fail)), Go(ctx, sleeper(0, 0, fail)))
+	if !errors.Is(err, fail) {
+		t.Fatalf("all failed: got error: %v; want: %v", err, fail)
+	}
+	if _, err := Any[int](ctx); err == nil {
+		t.Fatal("no futures: got nil error")
+	}
+}
+
+func TestRace(t *testing.T) {
+	ctx := context.Background()
+	fail := errors.New("fail")
+	loser := Go(ctx, sleeper(time.Hour, 1, nil))
+	if _, err := Race(ctx, Go(ctx, sleeper(0, 0, fail)), loser); err != fail {
+		t.Fatalf("got error: %v; want: %v", err, fail)
+	}
+	if _, err := loser.Result(ctx); err != context.Canceled {
+		t.Fatalf("loser: got error: %v; want: %v", err, context.Canceled)
+	}
+
+	slow := Go(ctx, sleeper(time.Hour, 0, nil))
+	defer slow.Cancel(nil)
+	wctx, cancel := context.WithTimeout(ctx, time.Millisecond)
+	defer cancel()
+	if _, err := Race(wctx, slow); err != context.DeadlineExceeded {
+		t.Fatalf("ctx done: got error: %v; want: %v", err, context.DeadlineExceeded)
+	}
+}
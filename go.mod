@@ -0,0 +1,3 @@
+module github.com/abursavich/syncutil
+
+go 1.24
@@ -0,0 +1,82 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package syncutil
+
+import (
+	"context"
+	"time"
+)
+
+// A Group manages an Init per key: calls to Do with the same key are
+// de-duplicated and their first successful result is memoized, while calls
+// with different keys are independent. It is like singleflight, but with
+// memoization of success and cancellation by context. Keys are spread over
+// shards, each with its own lock, so calls with unrelated keys rarely
+// contend (see WithShards). The zero value is ready to use with the default
+// options.
+type Group struct {
+	noCopy noCopy
+
+	cfg config
+	t   table[string]
+}
+
+// NewGroup returns a Group whose Inits are configured with the given
+// options, as with New.
+func NewGroup(opts ...Option) *Group {
+	g := new(Group)
+	g.cfg.apply(opts)
+	return g
+}
+
+// Do is like Init.Do for the Init of key.
+func (g *Group) Do(ctx context.Context, key string, fn func() (interface{}, error)) (interface{}, error) {
+	return g.init(key).Do(ctx, fn)
+}
+
+// DoContext is like Init.DoContext for the Init of key.
+func (g *Group) DoContext(ctx context.Context, key string, fn func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	return g.init(key).DoContext(ctx, fn)
+}
+
+// DoShared is like Init.DoShared for the Init of key.
+func (g *Group) DoShared(ctx context.Context, key string, fn func(ctx context.Context) (interface{}, error)) (interface{}, Source, error) {
+	return g.init(key).DoShared(ctx, fn)
+}
+
+// DoTTL is like Do, but fn also returns how long its value stays memoized
+// for key, replacing the default set by WithTTL. If the duration is not
+// positive, the default applies. Once the value of key expires, the next
+// call for key runs fn again, shared by concurrent callers for key.
+func (g *Group) DoTTL(ctx context.Context, key string, fn func() (interface{}, time.Duration, error)) (interface{}, error) {
+	return g.init(key).DoContext(ctx, func(context.Context) (interface{}, error) {
+		val, ttl, err := fn()
+		if err != nil {
+			return val, err
+		}
+		return expiring{val: val, ttl: ttl}, nil
+	})
+}
+
+// Forget drops the Init of key, so that the next call to Do for key runs fn
+// again, without affecting other keys. Calls in flight for key are not
+// affected: they share the results of their run, which are then dropped.
+// The memoized value, if any, is passed to the finalizer set by WithFinalizer,
+// and so is the value of a run in flight once its callers have it.
+func (g *Group) Forget(key string) {
+	if i := g.t.remove(&g.cfg, key); i != nil {
+		i.drop()
+	}
+}
+
+// ForgetAll is like Forget for every key.
+func (g *Group) ForgetAll() {
+	g.t.removeAll((*Init).drop)
+}
+
+// init returns the Init of key, creating it if necessary.
+func (g *Group) init(key string) *Init {
+	return g.t.get(&g.cfg, key)
+}
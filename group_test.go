@@ -0,0 +1,326 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package syncutil
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestGroup(t *testing.T) {
+	var g Group
+	ctx := context.Background()
+	var runs [2]uint32
+	fn := func(k int, val string) func() (interface{}, error) {
+		return func() (interface{}, error) {
+			atomic.AddUint32(&runs[k], 1)
+			return val, nil
+		}
+	}
+	testGroupFunc(t, &g, "a", ctx, "A", nil, fn(0, "A"))
+	testGroupFunc(t, &g, "b", ctx, "B", nil, fn(1, "B"))
+	testGroupFunc(t, &g, "a", ctx, "A", nil, fn(0, "other"))
+	for k, n := range runs {
+		if n != 1 {
+			t.Fatalf("fn %d ran %d times; want: 1", k, n)
+		}
+	}
+
+	// Options apply to the Init of every key.
+	fail := errors.New("fail")
+	p := NewGroup(WithPermanentErrors())
+	testGroupFunc(t, p, "a", ctx, nil, fail, func() (interface{}, error) {
+		return nil, fail
+	})
+	testGroupFunc(t, p, "a", ctx, nil, fail, func() (interface{}, error) {
+		return "ok", nil
+	})
+}
+
+func testGroupFunc(t *testing.T, g *Group, key string, ctx context.Context, val interface{}, err error, fn func() (interface{}, error)) {
+	t.Helper()
+	i := g.init(key)
+	if i != g.init(key) {
+		t.Fatalf("%s: got distinct Inits for the same key", key)
+	}
+	testFunc(t, i, key, ctx, val, err, fn)
+	if v, e := g.Do(ctx, key, fn); v != val || e != err {
+		t.Fatalf("%s: got: (%v, %v); want: (%v, %v)", key, v, e, val, err)
+	}
+}
+
+func TestGroupForget(t *testing.T) {
+	var finalized []interface{}
+	g := NewGroup(WithFinalizer(func(val interface{}) {
+		finalized = append(finalized, val)
+	}))
+	ctx := context.Background()
+	val := func(v string) func() (interface{}, error) {
+		return func() (interface{}, error) { return v, nil }
+	}
+	testGroupFunc(t, g, "a", ctx, "A1", nil, val("A1"))
+	testGroupFunc(t, g, "b", ctx, "B1", nil, val("B1"))
+	g.Forget("a")
+	g.Forget("missing")
+	testGroupFunc(t, g, "a", ctx, "A2", nil, val("A2"))
+	testGroupFunc(t, g, "b", ctx, "B1", nil, val("B2"))
+	if len(finalized) != 1 || finalized[0] != "A1" {
+		t.Fatalf("finalized: %v; want: [A1]", finalized)
+	}
+
+	g.ForgetAll()
+	testGroupFunc(t, g, "a", ctx, "A3", nil, val("A3"))
+	testGroupFunc(t, g, "b", ctx, "B3", nil, val("B3"))
+	if len(finalized) != 3 {
+		t.Fatalf("finalized: %v; want: [A1 A2 B1] in any order", finalized)
+	}
+}
+
+func TestGroupForgetInFlight(t *testing.T) {
+	finalized := make(chan interface{}, 1)
+	g := NewGroup(WithFinalizer(func(val interface{}) { finalized <- val }))
+	ctx := context.Background()
+	release := make(chan struct{})
+	started := make(chan struct{})
+	done := make(chan interface{})
+	go func() {
+		v, _ := g.Do(ctx, "a", func() (interface{}, error) {
+			close(started)
+			<-release
+			return "A1", nil
+		})
+		done <- v
+	}()
+	<-started
+	g.Forget("a")
+	close(release)
+	if v := <-done; v != "A1" {
+		t.Fatalf("in flight: got: %v; want: A1", v)
+	}
+	select {
+	case v := <-finalized:
+		if v != "A1" {
+			t.Fatalf("finalized: %v; want: A1", v)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("value of the run in flight was not finalized")
+	}
+	testGroupFunc(t, g, "a", ctx, "A2", nil, func() (interface{}, error) { return "A2", nil })
+}
+
+func TestGroupShards(t *testing.T) {
+	for _, tt := range []struct{ n, want int }{
+		{1, 1},
+		{2, 2},
+		{3, 4},
+		{64, 64},
+		{100, 128},
+	} {
+		if got := numShards(tt.n); got != tt.want {
+			t.Errorf("numShards(%d): got: %d; want: %d", tt.n, got, tt.want)
+		}
+	}
+	if got := numShards(0); got < runtime.GOMAXPROCS(0) || got&(got-1) != 0 {
+		t.Errorf("numShards(0): got: %d; want: a power of two >= GOMAXPROCS", got)
+	}
+
+	ctx := context.Background()
+	for _, n := range []int{1, 16} {
+		g := NewGroup(WithShards(n))
+		for k := 0; k < 100; k++ {
+			key := strconv.Itoa(k)
+			testGroupFunc(t, g, key, ctx, k, nil, func() (interface{}, error) {
+				return k, nil
+			})
+		}
+		if got := len(g.t.shards); got != n {
+			t.Fatalf("got %d shards; want: %d", got, n)
+		}
+	}
+}
+
+// BenchmarkGroupDo measures memoized calls with many keys from parallel
+// callers, with a single shard and with the default number of shards. Run
+// with -cpu to vary the number of callers.
+func BenchmarkGroupDo(b *testing.B) {
+	const keys = 1 << 10
+	names := make([]string, keys)
+	for k := range names {
+		names[k] = strconv.Itoa(k)
+	}
+	fn := func() (interface{}, error) { return nil, nil }
+	ctx := context.Background()
+	for _, bb := range []struct {
+		name string
+		opts []Option
+	}{
+		{"shards=1", []Option{WithShards(1)}},
+		{"shards=default", nil},
+		{"shards=default,max=keys", []Option{WithMaxEntries(keys)}},
+		{"shards=default,max=keys/2", []Option{WithMaxEntries(keys / 2)}},
+	} {
+		b.Run(bb.name, func(b *testing.B) {
+			b.ReportAllocs()
+			g := NewGroup(bb.opts...)
+			for _, key := range names {
+				g.Do(ctx, key, fn)
+			}
+			var seq uint32
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				k := atomic.AddUint32(&seq, 7919)
+				for pb.Next() {
+					g.Do(ctx, names[k%keys], fn)
+					k++
+				}
+			})
+		})
+	}
+}
+
+func TestGroupMaxEntries(t *testing.T) {
+	var finalized []interface{}
+	g := NewGroup(WithShards(1), WithMaxEntries(2), WithFinalizer(func(val interface{}) {
+		finalized = append(finalized, val)
+	}))
+	ctx := context.Background()
+	val := func(v string) func() (interface{}, error) {
+		return func() (interface{}, error) { return v, nil }
+	}
+	testGroupFunc(t, g, "a", ctx, "A1", nil, val("A1"))
+	testGroupFunc(t, g, "b", ctx, "B1", nil, val("B1"))
+	testGroupFunc(t, g, "a", ctx, "A1", nil, val("A2")) // a is used more recently than b
+	testGroupFunc(t, g, "c", ctx, "C1", nil, val("C1")) // evicts b
+	if len(finalized) != 1 || finalized[0] != "B1" {
+		t.Fatalf("finalized: %v; want: [B1]", finalized)
+	}
+	testGroupFunc(t, g, "a", ctx, "A1", nil, val("A2"))
+	testGroupFunc(t, g, "b", ctx, "B2", nil, val("B2")) // evicts c
+	if len(finalized) != 2 || finalized[1] != "C1" {
+		t.Fatalf("finalized: %v; want: [B1 C1]", finalized)
+	}
+	if n := groupLen(g); n != 2 {
+		t.Fatalf("got %d entries; want: 2", n)
+	}
+}
+
+func TestGroupMaxEntriesSharded(t *testing.T) {
+	const N = 100
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(64)) // many more shards than entries
+	var mu sync.Mutex
+	var finalized []interface{}
+	g := NewGroup(WithMaxEntries(N), WithFinalizer(func(val interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		finalized = append(finalized, val)
+	}))
+	ctx := context.Background()
+	for k := 0; k < N; k++ {
+		g.Do(ctx, strconv.Itoa(k), func() (interface{}, error) { return k, nil })
+	}
+	if n := len(g.t.shards); n <= N {
+		t.Fatalf("got %d shards; want more than %d", n, N)
+	}
+	if n := groupLen(g); n != N || len(finalized) != 0 {
+		t.Fatalf("at capacity: got %d entries, finalized %v; want: %d entries, none finalized", n, finalized, N)
+	}
+	g.Do(ctx, "0", nil) // 0 is now the most recently used
+	g.Do(ctx, "new", func() (interface{}, error) { return "new", nil })
+	if n := groupLen(g); n != N || len(finalized) != 1 || finalized[0] == 0 {
+		t.Fatalf("over capacity: got %d entries, finalized %v; want: %d entries, one other than 0 finalized", n, finalized, N)
+	}
+
+	// Evicting an entry with a run in flight finalizes its value.
+	finalized = nil
+	release := make(chan struct{})
+	started := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		g.Do(ctx, "slow", func() (interface{}, error) {
+			close(started)
+			<-release
+			return "slow", nil
+		})
+		close(done)
+	}()
+	<-started
+	for k := 0; groupHas(g, "slow"); k++ {
+		if k == 100*N {
+			t.Fatal("slow never evicted")
+		}
+		g.Do(ctx, "more"+strconv.Itoa(k), func() (interface{}, error) { return k, nil })
+	}
+	if n := groupLen(g); n != N {
+		t.Fatalf("after evictions: got %d entries; want: %d", n, N)
+	}
+	close(release)
+	<-done
+	waitFor(t, "slow finalized", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, v := range finalized {
+			if v == "slow" {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// groupLen returns the number of entries of g.
+func groupLen(g *Group) int {
+	n := 0
+	g.t.each(func(string, *Init) { n++ })
+	return n
+}
+
+// groupHas reports whether g has an entry for key, without using it.
+func groupHas(g *Group, key string) bool {
+	ok := false
+	g.t.each(func(k string, _ *Init) { ok = ok || k == key })
+	return ok
+}
+
+func TestGroupDoTTL(t *testing.T) {
+	const ttl = 50 * time.Millisecond
+	g := NewGroup(WithTTL(time.Hour))
+	ctx := context.Background()
+	var runs [2]uint32
+	fn := func(k int, ttl time.Duration) func() (interface{}, time.Duration, error) {
+		return func() (interface{}, time.Duration, error) {
+			return atomic.AddUint32(&runs[k], 1), ttl, nil
+		}
+	}
+	for k := 0; k < 2; k++ {
+		if v, err := g.DoTTL(ctx, "short", fn(0, ttl)); v != uint32(1) || err != nil {
+			t.Fatalf("short: got: (%v, %v); want: (1, <nil>)", v, err)
+		}
+		if v, err := g.DoTTL(ctx, "default", fn(1, 0)); v != uint32(1) || err != nil {
+			t.Fatalf("default: got: (%v, %v); want: (1, <nil>)", v, err)
+		}
+	}
+	time.Sleep(2 * ttl)
+	if v, err := g.DoTTL(ctx, "short", fn(0, ttl)); v != uint32(2) || err != nil {
+		t.Fatalf("short after expiry: got: (%v, %v); want: (2, <nil>)", v, err)
+	}
+	if v, err := g.DoTTL(ctx, "default", fn(1, 0)); v != uint32(1) || err != nil {
+		t.Fatalf("default after short expiry: got: (%v, %v); want: (1, <nil>)", v, err)
+	}
+
+	// The value is unwrapped before it reaches the options.
+	var finalized interface{}
+	f := NewGroup(WithFinalizer(func(val interface{}) { finalized = val }))
+	f.DoTTL(ctx, "a", func() (interface{}, time.Duration, error) { return "A", time.Hour, nil })
+	f.Forget("a")
+	if finalized != "A" {
+		t.Fatalf("finalized: got: %v; want: A", finalized)
+	}
+}
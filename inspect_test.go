@@ -0,0 +1,153 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package syncutil
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// protocol is a snapshot of the handshake between Do and run.
+type protocol struct {
+	idle    bool // no run is in flight
+	done    bool // done is closed, so a value is memoized
+	waiters int  // callers waiting on the in-flight run
+}
+
+func inspect(i *Init) protocol {
+	i.mu.Lock()
+	idle := i.cur == nil
+	var done chan struct{}
+	if i.gen != nil {
+		done = i.gen.done
+	}
+	i.mu.Unlock()
+	p := protocol{
+		idle:    idle,
+		waiters: int(atomic.LoadInt32(&i.waiters)),
+	}
+	if done != nil {
+		select {
+		case <-done:
+			p.done = true
+		default:
+		}
+	}
+	return p
+}
+
+// waitProtocol waits for i to reach the handshake state want.
+func waitProtocol(t *testing.T, i *Init, desc string, want protocol) {
+	deadline := time.Now().Add(time.Second)
+	for {
+		got := inspect(i)
+		if got == want {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s: got protocol %+v; want: %+v", desc, got, want)
+		}
+		runtime.Gosched()
+	}
+}
+
+func TestProtocolFailure(t *testing.T) {
+	const N = 5
+	i := new(Init)
+	if got, want := inspect(i), (protocol{idle: true}); got != want {
+		t.Fatalf("uninitialized: got protocol %+v; want: %+v", got, want)
+	}
+	ctx := context.Background()
+	fail := errors.New("fail")
+	release := make(chan struct{})
+	errc := make(chan error, N)
+	for k := 0; k < N; k++ {
+		go func() {
+			_, err := i.Do(ctx, func() (interface{}, error) {
+				<-release
+				return nil, fail
+			})
+			errc <- err
+		}()
+	}
+	// Every caller waits on the run in flight.
+	waitProtocol(t, i, "running", protocol{waiters: N})
+	close(release)
+	for k := 0; k < N; k++ {
+		if err := <-errc; err != fail {
+			t.Fatalf("got error: %v; want: %v", err, fail)
+		}
+	}
+	// The failed run lets the next caller start a new one.
+	waitProtocol(t, i, "failed", protocol{idle: true})
+}
+
+func TestProtocolSuccess(t *testing.T) {
+	i := new(Init)
+	ctx, cancel := context.WithCancel(context.Background())
+	release := make(chan struct{})
+	fn := func() (interface{}, error) {
+		cancel()
+		<-release
+		return "ok", nil
+	}
+	if _, err := i.Do(ctx, fn); err != context.Canceled {
+		t.Fatalf("got error: %v; want: %v", err, context.Canceled)
+	}
+	// The abandoned run stays in flight with no one waiting.
+	waitProtocol(t, i, "abandoned", protocol{})
+	close(release)
+	// The successful run closes done.
+	waitProtocol(t, i, "finished", protocol{idle: true, done: true})
+}
+
+func TestPrecedenceRegister(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for k := 0; k < 100; k++ {
+		// Simulate a run that published its value after the fast path
+		// check: the value is not in memo yet, but done is closed.
+		i := &Init{gen: &generation{done: make(chan struct{}), val: "ok"}}
+		close(i.gen.done)
+		if val, err := i.Do(ctx, nil); val != "ok" || err != nil {
+			t.Fatalf("got: (%v, %v); want: (ok, <nil>)", val, err)
+		}
+	}
+}
+
+func TestPrecedenceUnregister(t *testing.T) {
+	fail := errors.New("fail")
+	for k := 0; k < 100; k++ {
+		i := new(Init)
+		ctx, cancel := context.WithCancel(context.Background())
+		release := make(chan struct{})
+		errc := make(chan error)
+		go func() {
+			_, err := i.Do(ctx, func() (interface{}, error) {
+				<-release
+				return nil, fail
+			})
+			errc <- err
+		}()
+		waitProtocol(t, i, "running", protocol{waiters: 1})
+		// Let the run publish its error before the caller gives up.
+		i.mu.Lock()
+		close(release)
+		for i.lastErr == nil {
+			i.mu.Unlock()
+			runtime.Gosched()
+			i.mu.Lock()
+		}
+		i.mu.Unlock()
+		cancel()
+		if err := <-errc; err != fail {
+			t.Fatalf("got error: %v; want: %v", err, fail)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package syncutil
+
+import "sync/atomic"
+
+// A Logger reports the progress of runs: attempts, retries, callers giving
+// up, and calls to fn that complete in the background. A *log.Logger is a
+// Logger. Events are reported as single lines prefixed by "syncutil: ".
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+var defaultLogger atomic.Value // of loggerBox
+
+type loggerBox struct{ Logger }
+
+// SetDefaultLogger sets the Logger used by values in this package that are
+// not given one with WithLogger. A nil Logger disables logging, which is the
+// default.
+func SetDefaultLogger(l Logger) {
+	defaultLogger.Store(loggerBox{l})
+}
+
+// WithLogger returns an Option that reports the progress of runs to l
+// instead of the default Logger. See SetDefaultLogger.
+func WithLogger(l Logger) Option {
+	return func(c *config) {
+		c.logger = l
+	}
+}
+
+// logf reports an event to i's Logger, if any.
+func (i *Init) logf(format string, v ...interface{}) {
+	l := i.cfg.logger
+	if l == nil {
+		b, _ := defaultLogger.Load().(loggerBox)
+		l = b.Logger
+	}
+	if l != nil {
+		l.Printf("syncutil: "+format, v...)
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package syncutil
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testLogger struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (l *testLogger) Printf(format string, v ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lines = append(l.lines, fmt.Sprintf(format, v...))
+}
+
+func (l *testLogger) Lines() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.lines...)
+}
+
+func TestLogger(t *testing.T) {
+	l := new(testLogger)
+	i := New(WithLogger(l), WithBackoff(Backoff{Initial: time.Millisecond}))
+	ctx := context.Background()
+	fail := errors.New("fail")
+	if _, err := i.Do(ctx, func() (interface{}, error) { return nil, fail }); err != fail {
+		t.Fatalf("failure: got error: %v; want: %v", err, fail)
+	}
+	if _, err := i.Do(ctx, func() (interface{}, error) { return "ok", nil }); err != nil {
+		t.Fatalf("success: got error: %v", err)
+	}
+	got := l.Lines()
+	want := []string{
+		"syncutil: run started (attempt 1)",
+		"syncutil: run failed after D (attempt 1): fail",
+		"syncutil: retrying after D",
+		"syncutil: run started (attempt 2)",
+		"syncutil: run succeeded after D (attempt 2)",
+	}
+	for k := range got {
+		got[k] = maskDurations(got[k])
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got lines: %q; want: %q", got, want)
+	}
+}
+
+// maskDurations replaces the durations in a logged line, which vary, by D.
+func maskDurations(line string) string {
+	return durationRE.ReplaceAllString(line, "after D")
+}
+
+var durationRE = regexp.MustCompile(`after [0-9.]+[a-zµ]+`)
+
+func TestDefaultLogger(t *testing.T) {
+	l := new(testLogger)
+	SetDefaultLogger(l)
+	defer SetDefaultLogger(nil)
+	if _, err := new(Init).Do(context.Background(), func() (interface{}, error) {
+		return "ok", nil
+	}); err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+	got := l.Lines()
+	want := []string{
+		"syncutil: run started (attempt 1)",
+		"syncutil: run succeeded after D (attempt 1)",
+	}
+	// Runs left over from other tests may log too, so only look for ours.
+	seen := make(map[string]bool)
+	for _, line := range got {
+		seen[maskDurations(line)] = true
+	}
+	for _, line := range want {
+		if !seen[line] {
+			t.Fatalf("got lines: %q; want line: %q", got, line)
+		}
+	}
+}
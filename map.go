@@ -0,0 +1,73 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package syncutil
+
+import (
+	"context"
+	"time"
+)
+
+// A Map is like Group, but with keys of type K and values of type V, as
+// TypedInit is to Init. It may replace a sync.Map of Inits. The zero value
+// is ready to use with the default options.
+type Map[K comparable, V any] struct {
+	noCopy noCopy
+
+	cfg config
+	t   table[K]
+}
+
+// NewMap returns a Map whose entries are configured with the given options,
+// as with New. A value given to WithColdStartDefault must be of type V.
+func NewMap[K comparable, V any](opts ...Option) *Map[K, V] {
+	m := new(Map[K, V])
+	m.cfg.apply(opts)
+	return m
+}
+
+// LoadOrInit returns the value of key, calling fn to initialize it if
+// necessary, as with TypedInit.Do.
+func (m *Map[K, V]) LoadOrInit(ctx context.Context, key K, fn func() (V, error)) (V, error) {
+	v, err := m.t.get(&m.cfg, key).Do(ctx, func() (interface{}, error) {
+		return fn()
+	})
+	if err != nil {
+		var zero V
+		return zero, err
+	}
+	val, _ := v.(V) // a nil interface value is the zero V
+	return val, nil
+}
+
+// Load returns the memoized value of key and true, without blocking and
+// without starting a run, as with TypedInit.TryGet.
+func (m *Map[K, V]) Load(key K) (V, bool) {
+	if i := m.t.lookup(&m.cfg, key); i != nil {
+		if v, ok := i.TryGet(); ok {
+			val, _ := v.(V)
+			return val, true
+		}
+	}
+	var zero V
+	return zero, false
+}
+
+// Store memoizes val for key, as if fn had returned it. It replaces the
+// entry of key like Delete, and later calls to LoadOrInit for key return
+// val without calling fn.
+func (m *Map[K, V]) Store(key K, val V) {
+	i := &Init{cfg: m.cfg}
+	i.store(val, time.Time{})
+	if old := m.t.put(&m.cfg, key, i); old != nil {
+		old.drop()
+	}
+}
+
+// Delete drops the entry of key, like Group.Forget.
+func (m *Map[K, V]) Delete(key K) {
+	if i := m.t.remove(&m.cfg, key); i != nil {
+		i.drop()
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package syncutil
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync/atomic"
+	"testing"
+)
+
+func TestMap(t *testing.T) {
+	var finalized []int
+	m := NewMap[int, int](WithFinalizer(func(val interface{}) {
+		finalized = append(finalized, val.(int))
+	}))
+	ctx := context.Background()
+	var runs uint32
+	square := func(k int) func() (int, error) {
+		return func() (int, error) {
+			atomic.AddUint32(&runs, 1)
+			return k * k, nil
+		}
+	}
+	if v, ok := m.Load(3); ok {
+		t.Fatalf("Load before init: got: (%v, true); want: (0, false)", v)
+	}
+	fail := errors.New("fail")
+	if v, err := m.LoadOrInit(ctx, 3, func() (int, error) { return 0, fail }); v != 0 || err != fail {
+		t.Fatalf("failure: got: (%v, %v); want: (0, %v)", v, err, fail)
+	}
+	if v, ok := m.Load(3); ok {
+		t.Fatalf("Load after failure: got: (%v, true); want: (0, false)", v)
+	}
+	for k := 0; k < 2; k++ {
+		if v, err := m.LoadOrInit(ctx, 3, square(3)); v != 9 || err != nil {
+			t.Fatalf("LoadOrInit: got: (%v, %v); want: (9, <nil>)", v, err)
+		}
+	}
+	if n := atomic.LoadUint32(&runs); n != 1 {
+		t.Fatalf("fn ran %d times; want: 1", n)
+	}
+	if v, ok := m.Load(3); v != 9 || !ok {
+		t.Fatalf("Load: got: (%v, %v); want: (9, true)", v, ok)
+	}
+
+	m.Store(3, 10)
+	m.Store(4, 16)
+	if v, err := m.LoadOrInit(ctx, 3, square(3)); v != 10 || err != nil {
+		t.Fatalf("LoadOrInit after Store: got: (%v, %v); want: (10, <nil>)", v, err)
+	}
+	if v, ok := m.Load(4); v != 16 || !ok {
+		t.Fatalf("Load after Store: got: (%v, %v); want: (16, true)", v, ok)
+	}
+	m.Delete(3)
+	m.Delete(5)
+	if v, ok := m.Load(3); ok {
+		t.Fatalf("Load after Delete: got: (%v, true); want: (0, false)", v)
+	}
+	if v, err := m.LoadOrInit(ctx, 3, square(3)); v != 9 || err != nil {
+		t.Fatalf("LoadOrInit after Delete: got: (%v, %v); want: (9, <nil>)", v, err)
+	}
+	if n := atomic.LoadUint32(&runs); n != 2 {
+		t.Fatalf("fn ran %d times; want: 2", n)
+	}
+	if len(finalized) != 2 || finalized[0] != 9 || finalized[1] != 10 {
+		t.Fatalf("finalized: %v; want: [9 10]", finalized)
+	}
+
+	// A nil interface value is memoized as the zero value.
+	var r Map[string, io.Reader]
+	if v, err := r.LoadOrInit(ctx, "a", func() (io.Reader, error) { return nil, nil }); v != nil || err != nil {
+		t.Fatalf("nil interface: got: (%v, %v); want: (<nil>, <nil>)", v, err)
+	}
+	if v, ok := r.Load("a"); v != nil || !ok {
+		t.Fatalf("nil interface: Load: got: (%v, %v); want: (<nil>, true)", v, ok)
+	}
+}
@@ -0,0 +1,33 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package syncutil
+
+import (
+	"sync/atomic"
+	"unsafe"
+)
+
+// noCopy may be embedded into structs which must not be copied after the
+// first use, so that go vet's copylocks checker flags copies.
+type noCopy struct{}
+
+// Lock is a no-op used by go vet's copylocks checker.
+func (*noCopy) Lock() {}
+
+// Unlock is a no-op used by go vet's copylocks checker.
+func (*noCopy) Unlock() {}
+
+// copyChecker holds back pointer to itself to detect object copying.
+type copyChecker uintptr
+
+// check panics with msg if c has been copied since its first check.
+func (c *copyChecker) check(msg string) {
+	p := uintptr(unsafe.Pointer(c))
+	if atomic.LoadUintptr((*uintptr)(c)) != p &&
+		!atomic.CompareAndSwapUintptr((*uintptr)(c), 0, p) &&
+		atomic.LoadUintptr((*uintptr)(c)) != p {
+		panic(msg)
+	}
+}
@@ -0,0 +1,459 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package syncutil
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"runtime"
+	"time"
+)
+
+// An Option configures an Init.
+type Option func(*config)
+
+type config struct {
+	lockOSThread bool
+	trackLeaks   bool
+
+	recover bool
+
+	runTimeout time.Duration
+
+	preCommit func(val interface{}) error
+
+	coldStart    bool
+	coldStartVal interface{}
+
+	cancelOnAbandon bool
+	cleanup         func(val interface{})
+	finalizer       func(val interface{})
+
+	permanentErrors bool
+
+	backoff *Backoff
+
+	maxAttempts int
+
+	ttl          time.Duration
+	errorTTL     time.Duration
+	refreshAhead time.Duration
+	maxStale     time.Duration
+
+	hedgeDelay time.Duration
+
+	hooks Hooks
+
+	logger Logger
+
+	traceTask string
+
+	initErrors bool
+	joinErrors bool
+
+	shards     int
+	maxEntries int
+
+	batchWindow  time.Duration
+	maxBatchSize int
+
+	locker Locker
+}
+
+// New returns an Init configured with the given options.
+// The zero value of Init is ready to use with the default options.
+func New(opts ...Option) *Init {
+	i := new(Init)
+	i.cfg.apply(opts)
+	return i
+}
+
+func (c *config) apply(opts []Option) {
+	for _, opt := range opts {
+		opt(c)
+	}
+}
+
+// WithLockOSThread returns an Option that wires the goroutine calling fn to
+// its OS thread for the duration of fn, as with runtime.LockOSThread. It is
+// intended for initializers that depend on thread-local state, such as some
+// cgo libraries and syscalls. The thread is unlocked after fn returns.
+func WithLockOSThread() Option {
+	return func(c *config) {
+		c.lockOSThread = true
+	}
+}
+
+// WithLeakTracking returns an Option that makes i count abandoned runs:
+// runs whose callers have all given up while fn is still running.
+// See Init.LeakedRuns.
+func WithLeakTracking() Option {
+	return func(c *config) {
+		c.trackLeaks = true
+	}
+}
+
+// WithRecover returns an Option that recovers a panic in fn and returns it to
+// waiting callers as a *PanicError, which includes the stack of the
+// panicking goroutine. The run fails, so a later caller may retry it.
+func WithRecover() Option {
+	return func(c *config) {
+		c.recover = true
+	}
+}
+
+// WithIsolatedRun returns an Option that hardens each run of fn for untrusted
+// or flaky initializers. A panic in fn is recovered and returned to waiting
+// callers as a *PanicError. If fn does not return within timeout, the run is
+// detached from it and fails with ErrRunTimeout, so the next caller may start
+// a new run; the result of the detached call is discarded when it returns.
+// A non-positive timeout does not bound the run.
+func WithIsolatedRun(timeout time.Duration) Option {
+	return func(c *config) {
+		c.recover = true
+		c.runTimeout = timeout
+	}
+}
+
+// WithRunTimeout returns an Option that bounds each run of fn by its own
+// timeout, regardless of the contexts of its callers. If fn does not return
+// within d, the context passed to fn is canceled and the run fails with
+// ErrRunTimeout, so the next caller may start a new run; the result of the
+// timed out call is discarded when it returns. Unlike WithIsolatedRun, panics
+// in fn are not recovered. A non-positive d does not bound the run.
+func WithRunTimeout(d time.Duration) Option {
+	return func(c *config) {
+		c.runTimeout = d
+	}
+}
+
+// WithPreCommit returns an Option that calls fn with each successful result
+// immediately before it is memoized. If fn returns an error, the result is
+// discarded and the run fails with that error. The value is not visible to
+// any caller until fn approves it.
+func WithPreCommit(fn func(val interface{}) error) Option {
+	return func(c *config) {
+		c.preCommit = fn
+	}
+}
+
+// WithColdStartDefault returns an Option that makes Do return val instead of
+// blocking until a value is first memoized. The run of fn still starts (or
+// continues) in the background, as with Init.Start, and callers share its
+// value once it is memoized. This trades correctness for latency during the first access
+// only: after a Reset or an expiration, callers wait for the next run as
+// usual.
+func WithColdStartDefault(val interface{}) Option {
+	return func(c *config) {
+		c.coldStart = true
+		c.coldStartVal = val
+	}
+}
+
+// WithCancelOnAbandon returns an Option that cancels the context passed to fn
+// (see Init.DoContext) once every caller waiting on a run has given up, and
+// discards the results of that run. The next caller starts a new run, which
+// may overlap with the canceled call to fn until it returns.
+func WithCancelOnAbandon() Option {
+	return func(c *config) {
+		c.cancelOnAbandon = true
+	}
+}
+
+// WithForegroundRun returns an Option that keeps runs of fn in the foreground
+// of their callers, so that no value is created without a caller to own it.
+// As with WithCancelOnAbandon, a run is canceled once every caller waiting on
+// it has given up. If a discarded call to fn succeeds anyway, its value is
+// passed to cleanup, which may close it. Cleanup is also called with the value
+// of any other call whose results are discarded, such as one that returns
+// after WithRunTimeout or loses the race of WithHedging.
+func WithForegroundRun(cleanup func(val interface{})) Option {
+	return func(c *config) {
+		c.cancelOnAbandon = true
+		c.cleanup = cleanup
+	}
+}
+
+// WithPermanentErrors returns an Option that memoizes the first error returned
+// by fn as terminal, as if it were a successful result: all future callers get
+// it immediately until Reset is called. It is meant for failures that will
+// never succeed, such as bad configuration. Runs that are given up on, by
+// WithIsolatedRun's timeout or WithCancelOnAbandon, are not memoized.
+func WithPermanentErrors() Option {
+	return func(c *config) {
+		c.permanentErrors = true
+	}
+}
+
+// A Backoff describes how long an Init waits after consecutive failed runs
+// before it lets the next caller start a new run.
+type Backoff struct {
+	Initial    time.Duration // delay after the first failure
+	Multiplier float64       // growth of the delay per failure; less than 1 means 2
+	Max        time.Duration // maximum delay; zero means unbounded
+	Jitter     float64       // fraction of the delay that is randomized, in [0, 1]
+}
+
+// delay returns the delay after n consecutive failures.
+func (b *Backoff) delay(n int) time.Duration {
+	m := b.Multiplier
+	if m < 1 {
+		m = 2
+	}
+	limit := float64(b.Max)
+	if b.Max <= 0 {
+		limit = math.MaxInt64 // the longest Duration
+	}
+	d := float64(b.Initial)
+	for ; n > 1 && d < limit; n-- {
+		d *= m
+	}
+	d = math.Min(d, limit)
+	if j := b.Jitter; j > 0 {
+		if j > 1 {
+			j = 1
+		}
+		d -= d * j * rand.Float64()
+	}
+	if d >= math.MaxInt64 { // too long to convert exactly
+		return math.MaxInt64
+	}
+	return time.Duration(d)
+}
+
+// WithBackoff returns an Option that delays the next run after a failed run
+// according to b, so that callers don't stampede a recovering dependency.
+// Callers that arrive in the meantime wait for the delay to pass, or for
+// their context to be done; the first of them to arrive starts the next run.
+// A successful run resets the delay.
+func WithBackoff(b Backoff) Option {
+	return func(c *config) {
+		c.backoff = &b
+	}
+}
+
+// WithMaxAttempts returns an Option that gives up after n consecutive failed
+// runs of fn. The last failure is memoized as an *AttemptsExhaustedError,
+// which matches ErrAttemptsExhausted and wraps the last error, so future
+// callers get it without running fn again until Reset is called. Runs
+// abandoned with WithCancelOnAbandon do not count as attempts.
+func WithMaxAttempts(n int) Option {
+	return func(c *config) {
+		c.maxAttempts = n
+	}
+}
+
+// WithTTL returns an Option that expires memoized results d after they are
+// memoized. Once they expire, the next call to Do runs fn again; concurrent
+// callers share that run as usual.
+func WithTTL(d time.Duration) Option {
+	return func(c *config) {
+		c.ttl = d
+	}
+}
+
+// WithErrorTTL returns an Option that memoizes errors for d, so that calls to
+// Do return the error of the last run without running fn until it expires.
+// It caches the failed lookups of a missing key apart from WithTTL, which
+// applies to successful results. Errors of runs that gave up on fn, such as
+// ErrRunTimeout, are not memoized. WithErrorTTL takes precedence over
+// WithBackoff.
+func WithErrorTTL(d time.Duration) Option {
+	return func(c *config) {
+		c.errorTTL = d
+	}
+}
+
+// WithRefreshAhead returns an Option that refreshes results memoized with
+// WithTTL before they expire. The first call to Do within d of expiration
+// starts a run of its fn in the background and returns the current results
+// without waiting; when the run succeeds, its results atomically replace the
+// current ones. If it fails, the current results are served until they
+// expire, unless the failure is memoized, as with WithPermanentErrors.
+func WithRefreshAhead(d time.Duration) Option {
+	return func(c *config) {
+		c.refreshAhead = d
+	}
+}
+
+// WithStaleWhileRevalidate returns an Option that keeps serving results
+// memoized with WithTTL for up to maxStale after they expire. The first call
+// to Do after expiration starts a run of its fn in the background, and calls
+// return the stale results without waiting until the run succeeds and
+// replaces them. Once maxStale has passed, callers wait for the run.
+func WithStaleWhileRevalidate(maxStale time.Duration) Option {
+	return func(c *config) {
+		c.maxStale = maxStale
+	}
+}
+
+// WithHedging returns an Option that hedges each run of fn against a flaky
+// backend: if fn has not returned within d, a second call of fn is started
+// concurrently with the first. The first call to succeed provides the results
+// of the run, and the context of the other call is canceled; its results are
+// discarded when it returns. The run fails only if both calls fail, with the
+// error of the last one to return. A non-positive d disables hedging.
+func WithHedging(d time.Duration) Option {
+	return func(c *config) {
+		c.hedgeDelay = d
+	}
+}
+
+// Hooks are functions called by the runner of an Init as runs of fn start and
+// finish. The attempt number counts consecutive runs since the last success or
+// reset, starting at 1. Hooks are called synchronously, before waiting callers
+// receive the results, so they should return quickly. Nil hooks are ignored.
+type Hooks struct {
+	OnAttempt func(attempt int)                             // a run starts
+	OnSuccess func(attempt int, d time.Duration)            // a run succeeds
+	OnError   func(attempt int, d time.Duration, err error) // a run fails
+}
+
+// WithHooks returns an Option that calls h as runs of fn start and finish,
+// for example to log them or to alert on repeated failures. The hooks of
+// several WithHooks options are all called, in the order of the options.
+func WithHooks(h Hooks) Option {
+	return func(c *config) {
+		c.hooks = c.hooks.then(h)
+	}
+}
+
+// then returns Hooks that call the hooks of h and then those of next.
+func (h Hooks) then(next Hooks) Hooks {
+	if a, b := h.OnAttempt, next.OnAttempt; a == nil {
+		h.OnAttempt = b
+	} else if b != nil {
+		h.OnAttempt = func(attempt int) { a(attempt); b(attempt) }
+	}
+	if a, b := h.OnSuccess, next.OnSuccess; a == nil {
+		h.OnSuccess = b
+	} else if b != nil {
+		h.OnSuccess = func(attempt int, d time.Duration) { a(attempt, d); b(attempt, d) }
+	}
+	if a, b := h.OnError, next.OnError; a == nil {
+		h.OnError = b
+	} else if b != nil {
+		h.OnError = func(attempt int, d time.Duration, err error) { a(attempt, d, err); b(attempt, d, err) }
+	}
+	return h
+}
+
+// WithTraceTask returns an Option that annotates runs of fn for the execution
+// tracer: each run is a runtime/trace task of type name, each call to fn is a
+// region of type "syncutil.call" within it, and the error of a failed run is
+// logged to the task. The context passed to fn carries the task, so regions
+// of fn nest within it. This shows in "go tool trace" where lazy
+// initialization spends its time, such as during startup.
+func WithTraceTask(name string) Option {
+	return func(c *config) {
+		c.traceTask = name
+	}
+}
+
+// WithInitErrors returns an Option that wraps the error of each failed run in
+// an *InitError, which tells apart, say, a first attempt that failed fast from
+// a tenth attempt that timed out. Use errors.Is and errors.As to inspect the
+// wrapped error.
+func WithInitErrors() Option {
+	return func(c *config) {
+		c.initErrors = true
+	}
+}
+
+// WithJoinedErrors returns an Option that keeps the errors of consecutive
+// failed runs, so that once the attempts allowed by WithMaxAttempts have
+// failed, the memoized *AttemptsExhaustedError wraps all of them, joined by
+// errors.Join, rather than the error of the last attempt alone.
+func WithJoinedErrors() Option {
+	return func(c *config) {
+		c.joinErrors = true
+	}
+}
+
+// WithFinalizer returns an Option that passes each memoized value to fn once
+// it is dropped: by Reset, when it expires with WithTTL, when a refresh
+// replaces it, or when i is canceled. It may release resources held by the
+// value, such as sockets or cgo handles. The finalizer is called exactly once
+// per dropped value, without holding any locks of i. Callers that have
+// already observed the value may still be using it.
+func WithFinalizer(fn func(val interface{})) Option {
+	return func(c *config) {
+		c.finalizer = fn
+	}
+}
+
+// WithShards returns an Option that splits the keys of a Group or Map over n
+// shards, rounded up to a power of two, each with its own lock. By default,
+// there are four shards per GOMAXPROCS. It has no effect on an Init.
+func WithShards(n int) Option {
+	return func(c *config) {
+		c.shards = n
+	}
+}
+
+// WithMaxEntries returns an Option that bounds the number of keys of a Group
+// or Map to n, evicting a key beyond it as with Group.Forget, so its value is
+// passed to the finalizer set by WithFinalizer. The bound applies to the
+// whole table, whatever the number of shards; concurrent insertions may
+// briefly exceed it. The evicted key is the least recently used one of a few
+// sampled shards, which is exact with a single shard (see WithShards) and
+// approximate otherwise. It has no effect on an Init.
+func WithMaxEntries(n int) Option {
+	return func(c *config) {
+		c.maxEntries = n
+	}
+}
+
+// WithBatchWindow returns an Option that makes a BatchGroup collect the keys
+// of a batch for d after the first one before loading them. The default is
+// one millisecond. It has no effect on other types.
+func WithBatchWindow(d time.Duration) Option {
+	return func(c *config) {
+		c.batchWindow = d
+	}
+}
+
+// WithMaxBatchSize returns an Option that makes a BatchGroup load a batch as
+// soon as it has n keys, without waiting for the rest of its window. By
+// default, batches are unbounded. It has no effect on other types.
+func WithMaxBatchSize(n int) Option {
+	return func(c *config) {
+		c.maxBatchSize = n
+	}
+}
+
+// A Locker is a lock shared with other processes, such as an flock(2) on a
+// file or an advisory database lock. Lock blocks until the lock of key is
+// held or ctx is done, and returns a function that releases it. The key is
+// that of the entry of a Group, Map, or BatchGroup, formatted with
+// fmt.Sprint, or empty for an Init of its own.
+type Locker interface {
+	Lock(ctx context.Context, key string) (unlock func(), err error)
+}
+
+// WithLocker returns an Option that holds l for each run of fn, so that
+// processes sharing l never run fn for the same key at the same time. Since
+// a process may acquire l after another one has already succeeded, fn should
+// first check whether its work is done, such as an index already built on
+// disk, to make a single successful action hold across processes. An error
+// from Lock fails the run like an error from fn.
+//
+// The lock is taken once per run, by its first call of fn. With
+// WithHedging, the hedged call runs under the same hold of the lock, so
+// it may run alongside the first call within the process, but not alongside
+// calls of other processes. The lock is released once every call of the run
+// has returned, including calls that the run gave up on.
+func WithLocker(l Locker) Option {
+	return func(c *config) {
+		c.locker = l
+	}
+}
+
+// for testing
+var (
+	lockOSThread   = runtime.LockOSThread
+	unlockOSThread = runtime.UnlockOSThread
+)
@@ -0,0 +1,1047 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package syncutil
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"runtime"
+	"runtime/trace"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLockOSThread(t *testing.T) {
+	var locked int32
+	defer func(lock, unlock func()) {
+		lockOSThread, unlockOSThread = lock, unlock
+	}(lockOSThread, unlockOSThread)
+	lockOSThread = func() { atomic.AddInt32(&locked, 1) }
+	unlockOSThread = func() { atomic.AddInt32(&locked, -1) }
+
+	i := New(WithLockOSThread())
+	ctx := context.Background()
+	err := errors.New("fail")
+	var observed int32
+	testFunc(t, i, "locked failure", ctx, nil, err, func() (interface{}, error) {
+		atomic.StoreInt32(&observed, atomic.LoadInt32(&locked))
+		return nil, err
+	})
+	if n := atomic.LoadInt32(&observed); n != 1 {
+		t.Fatalf("failure: fn observed %d thread locks; want: 1", n)
+	}
+	if n := atomic.LoadInt32(&locked); n != 0 {
+		t.Fatalf("failure: %d thread locks held after fn; want: 0", n)
+	}
+	testFunc(t, i, "locked success", ctx, "ok", nil, func() (interface{}, error) {
+		atomic.StoreInt32(&observed, atomic.LoadInt32(&locked))
+		return "ok", nil
+	})
+	if n := atomic.LoadInt32(&observed); n != 1 {
+		t.Fatalf("success: fn observed %d thread locks; want: 1", n)
+	}
+	if n := atomic.LoadInt32(&locked); n != 0 {
+		t.Fatalf("success: %d thread locks held after fn; want: 0", n)
+	}
+}
+
+func TestLeakTracking(t *testing.T) {
+	i := New(WithLeakTracking())
+	bgCtx := context.Background()
+	ctx, cancel := context.WithCancel(bgCtx)
+	release := make(chan struct{})
+	fn := func() (interface{}, error) {
+		cancel()
+		<-release
+		return "ok", nil
+	}
+	if _, err := i.Do(ctx, fn); err != context.Canceled {
+		t.Fatalf("got error: %v; want: %v", err, context.Canceled)
+	}
+	waitLeakedRuns(t, i, 1)
+
+	// A new caller joins the abandoned run.
+	resc := make(chan interface{})
+	go func() {
+		val, _ := i.Do(bgCtx, fn)
+		resc <- val
+	}()
+	waitLeakedRuns(t, i, 0)
+	close(release)
+	if val := <-resc; val != "ok" {
+		t.Fatalf("got value: %v; want: ok", val)
+	}
+	if n := i.LeakedRuns(); n != 0 {
+		t.Fatalf("got %d leaked runs after fn returned; want: 0", n)
+	}
+}
+
+func TestLeakTrackingDisabled(t *testing.T) {
+	i := new(Init)
+	ctx, cancel := context.WithCancel(context.Background())
+	release := make(chan struct{})
+	defer close(release)
+	if _, err := i.Do(ctx, func() (interface{}, error) {
+		cancel()
+		<-release
+		return nil, nil
+	}); err != context.Canceled {
+		t.Fatalf("got error: %v; want: %v", err, context.Canceled)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if n := i.LeakedRuns(); n != 0 {
+		t.Fatalf("got %d leaked runs; want: 0", n)
+	}
+}
+
+func waitLeakedRuns(t *testing.T, i *Init, n int) {
+	deadline := time.Now().Add(time.Second)
+	for i.LeakedRuns() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d leaked runs; want: %d", i.LeakedRuns(), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestRecover(t *testing.T) {
+	i := New(WithRecover())
+	ctx := context.Background()
+	var perr *PanicError
+	_, err := i.Do(ctx, func() (interface{}, error) {
+		panic("boom")
+	})
+	if !errors.As(err, &perr) || perr.Value != "boom" || len(perr.Stack) == 0 {
+		t.Fatalf("got error: %#v; want: *PanicError with value boom", err)
+	}
+	testFunc(t, i, "retry", ctx, "ok", nil, func() (interface{}, error) {
+		return "ok", nil
+	})
+}
+
+func TestIsolatedRun(t *testing.T) {
+	i := New(WithIsolatedRun(20 * time.Millisecond))
+	ctx := context.Background()
+	if _, err := i.Do(ctx, func() (interface{}, error) {
+		panic("boom")
+	}); err == nil {
+		t.Fatal("panic: got nil error")
+	} else if perr, ok := err.(*PanicError); !ok || perr.Value != "boom" || len(perr.Stack) == 0 {
+		t.Fatalf("panic: got error: %#v; want: *PanicError with value boom", err)
+	}
+
+	release := make(chan struct{})
+	defer close(release)
+	start := time.Now()
+	testFunc(t, i, "timeout", ctx, nil, ErrRunTimeout, func() (interface{}, error) {
+		<-release
+		return "late", nil
+	})
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("timeout: took %v; want about 20ms", d)
+	}
+
+	testFunc(t, i, "success", ctx, "ok", nil, func() (interface{}, error) {
+		return "ok", nil
+	})
+}
+
+func TestRunTimeout(t *testing.T) {
+	i := New(WithRunTimeout(10 * time.Millisecond))
+	ctx := context.Background()
+	canceled := make(chan struct{})
+	if _, err := i.DoContext(ctx, func(ctx context.Context) (interface{}, error) {
+		<-ctx.Done()
+		close(canceled)
+		return "late", nil
+	}); err != ErrRunTimeout {
+		t.Fatalf("timeout: got error: %v; want: %v", err, ErrRunTimeout)
+	}
+	<-canceled // the timed out call's context is canceled
+	testFunc(t, i, "next run", ctx, "ok", nil, func() (interface{}, error) {
+		return "ok", nil
+	})
+}
+
+func TestPreCommit(t *testing.T) {
+	veto := errors.New("veto")
+	i := New(WithPreCommit(func(val interface{}) error {
+		if val == "bad" {
+			return veto
+		}
+		return nil
+	}))
+	ctx := context.Background()
+	var seen int32
+	peek := make(chan struct{})
+	go func() {
+		defer close(peek)
+		for atomic.LoadInt32(&seen) == 0 {
+			if val, err := i.GetOrExplain(ctx); err == nil && val == "bad" {
+				t.Error("reader observed vetoed value")
+				return
+			}
+		}
+	}()
+	testFunc(t, i, "vetoed", ctx, nil, veto, func() (interface{}, error) {
+		return "bad", nil
+	})
+	testFunc(t, i, "approved", ctx, "good", nil, func() (interface{}, error) {
+		return "good", nil
+	})
+	atomic.StoreInt32(&seen, 1)
+	<-peek
+}
+
+func BenchmarkColdStart(b *testing.B) {
+	const N = 1000
+	b.ReportAllocs()
+	ctx := context.Background()
+	for k := 0; k < b.N; k++ {
+		i := new(Init)
+		release := make(chan struct{})
+		fn := func() (interface{}, error) {
+			<-release
+			return nil, nil
+		}
+		var wg sync.WaitGroup
+		wg.Add(N)
+		for j := 0; j < N; j++ {
+			go func() {
+				defer wg.Done()
+				i.Do(ctx, fn)
+			}()
+		}
+		for atomic.LoadInt32(&i.waiters) < N {
+			runtime.Gosched()
+		}
+		close(release)
+		wg.Wait()
+	}
+}
+
+func TestColdStartDefault(t *testing.T) {
+	i := New(WithColdStartDefault("default"))
+	ctx := context.Background()
+	release := make(chan struct{})
+	var runs uint32
+	fn := func() (interface{}, error) {
+		atomic.AddUint32(&runs, 1)
+		<-release
+		return "real", nil
+	}
+	testFunc(t, i, "cold start", ctx, "default", nil, fn)
+	close(release)
+	if err := i.Wait(ctx, func(context.Context) (interface{}, error) {
+		return fn()
+	}); err != nil {
+		t.Fatalf("wait: got error: %v", err)
+	}
+	testFunc(t, i, "memoized", ctx, "real", nil, fn)
+	if n := atomic.LoadUint32(&runs); n != 1 {
+		t.Fatalf("fn ran %d times; want: 1", n)
+	}
+
+	// The default is only served before the first value.
+	i.Reset()
+	testFunc(t, i, "after reset", ctx, "real", nil, fn)
+	i = New(WithColdStartDefault("default"), WithTTL(10*time.Millisecond))
+	if err := i.Wait(ctx, func(context.Context) (interface{}, error) { return "real", nil }); err != nil {
+		t.Fatalf("wait: got error: %v", err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	testFunc(t, i, "after expiry", ctx, "real", nil, func() (interface{}, error) {
+		return "real", nil
+	})
+
+	// Callers served the default do not wait on the run, so it is neither
+	// abandoned nor leaked, and it is not canceled by WithForegroundRun.
+	i = New(WithColdStartDefault("default"), WithForegroundRun(func(interface{}) {}), WithLeakTracking())
+	release = make(chan struct{})
+	for k := 0; k < 3; k++ {
+		testFunc(t, i, "cold start", ctx, "default", nil, func() (interface{}, error) {
+			<-release
+			return "real", nil
+		})
+	}
+	if n := i.LeakedRuns(); n != 0 {
+		t.Fatalf("cold start: got %d leaked runs; want: 0", n)
+	}
+	close(release)
+	select {
+	case <-i.Done():
+	case <-time.After(time.Second):
+		t.Fatal("cold start: value never memoized")
+	}
+	if val, ok := i.TryGet(); !ok || val != "real" {
+		t.Fatalf("cold start: TryGet got (%v, %v); want: (real, true)", val, ok)
+	}
+	if n := i.RunCount(); n != 1 {
+		t.Fatalf("cold start: fn ran %d times; want: 1", n)
+	}
+}
+
+func TestCancelOnAbandon(t *testing.T) {
+	i := New(WithCancelOnAbandon(), WithLeakTracking())
+	ctx, cancel := context.WithCancel(context.Background())
+	release := make(chan struct{})
+	canceled := make(chan struct{})
+	_, err := i.DoContext(ctx, func(ctx context.Context) (interface{}, error) {
+		cancel()
+		<-ctx.Done()
+		close(canceled)
+		<-release
+		return "discarded", nil
+	})
+	if err != context.Canceled {
+		t.Fatalf("got error: %v; want: %v", err, context.Canceled)
+	}
+	<-canceled
+	waitLeakedRuns(t, i, 1)
+	testFunc(t, i, "next run", context.Background(), "ok", nil, func() (interface{}, error) {
+		return "ok", nil
+	})
+	close(release)
+	waitLeakedRuns(t, i, 0)
+	testFunc(t, i, "memoized", context.Background(), "ok", nil, func() (interface{}, error) {
+		return "discarded", nil
+	})
+}
+
+func TestForegroundRun(t *testing.T) {
+	cleaned := make(chan interface{}, 1)
+	i := New(WithForegroundRun(func(val interface{}) {
+		cleaned <- val
+	}))
+	ctx, cancel := context.WithCancel(context.Background())
+	_, err := i.DoContext(ctx, func(ctx context.Context) (interface{}, error) {
+		cancel()
+		<-ctx.Done()
+		return "orphan", nil // succeeds anyway
+	})
+	if err != context.Canceled {
+		t.Fatalf("got error: %v; want: %v", err, context.Canceled)
+	}
+	if val := <-cleaned; val != "orphan" {
+		t.Fatalf("cleaned up: %v; want: orphan", val)
+	}
+	testFunc(t, i, "next run", context.Background(), "ok", nil, func() (interface{}, error) {
+		return "ok", nil
+	})
+	select {
+	case val := <-cleaned:
+		t.Fatalf("cleaned up memoized value: %v", val)
+	default:
+	}
+}
+
+func TestPermanentErrors(t *testing.T) {
+	i := New(WithPermanentErrors(), WithIsolatedRun(10*time.Millisecond))
+	ctx := context.Background()
+	release := make(chan struct{})
+	defer close(release)
+	testFunc(t, i, "timeout", ctx, nil, ErrRunTimeout, func() (interface{}, error) {
+		<-release
+		return nil, nil
+	})
+	fail := errors.New("fail")
+	var runs uint32
+	testFunc(t, i, "failure", ctx, nil, fail, func() (interface{}, error) {
+		atomic.AddUint32(&runs, 1)
+		time.Sleep(time.Millisecond)
+		return nil, fail
+	})
+	testFunc(t, i, "memoized failure", ctx, nil, fail, func() (interface{}, error) {
+		atomic.AddUint32(&runs, 1)
+		return "ok", nil
+	})
+	if n := atomic.LoadUint32(&runs); n != 1 {
+		t.Fatalf("fn ran %d times; want: 1", n)
+	}
+	i.Reset()
+	testFunc(t, i, "after reset", ctx, "ok", nil, func() (interface{}, error) {
+		return "ok", nil
+	})
+}
+
+func TestBackoff(t *testing.T) {
+	const d = 20 * time.Millisecond
+	i := New(WithBackoff(Backoff{Initial: d, Multiplier: 2, Max: 2 * d}))
+	ctx := context.Background()
+	fail := errors.New("fail")
+	var last time.Time
+	var delays []time.Duration
+	fn := func() (interface{}, error) {
+		now := time.Now()
+		if !last.IsZero() {
+			delays = append(delays, now.Sub(last))
+		}
+		last = now
+		if len(delays) < 3 {
+			return nil, fail
+		}
+		return "ok", nil
+	}
+	for k := 0; k < 3; k++ {
+		if _, err := i.Do(ctx, fn); err != fail {
+			t.Fatalf("attempt %d: got error: %v; want: %v", k, err, fail)
+		}
+	}
+	if val, err := i.Do(ctx, fn); val != "ok" || err != nil {
+		t.Fatalf("got: (%v, %v); want: (ok, <nil>)", val, err)
+	}
+	for k, want := range []time.Duration{d, 2 * d, 2 * d} {
+		if got := delays[k]; got < want {
+			t.Fatalf("retry %d: got delay %v; want at least %v", k+1, got, want)
+		}
+	}
+
+	// Callers do not wait past their own context during a delay.
+	i = New(WithBackoff(Backoff{Initial: time.Hour}))
+	i.Do(ctx, func() (interface{}, error) { return nil, fail })
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if _, err := i.Do(ctx, fn); err != context.DeadlineExceeded {
+		t.Fatalf("during delay: got error: %v; want: %v", err, context.DeadlineExceeded)
+	}
+
+	// Cold start callers get the default without waiting for the delay.
+	i = New(WithBackoff(Backoff{Initial: time.Hour}), WithColdStartDefault("default"))
+	i.Wait(context.Background(), func(context.Context) (interface{}, error) { return nil, fail })
+	if val, err := i.Do(context.Background(), fn); val != "default" || err != nil {
+		t.Fatalf("cold start during delay: got: (%v, %v); want: (default, <nil>)", val, err)
+	}
+}
+
+func TestBackoffDelay(t *testing.T) {
+	b := Backoff{Initial: 100 * time.Millisecond, Multiplier: 3, Max: time.Second}
+	for k, want := range []time.Duration{100 * time.Millisecond, 300 * time.Millisecond, 900 * time.Millisecond, time.Second, time.Second} {
+		if got := b.delay(k + 1); got != want {
+			t.Errorf("delay(%d): got: %v; want: %v", k+1, got, want)
+		}
+	}
+	// Without a maximum, the delay saturates instead of overflowing.
+	unbounded := Backoff{Initial: 100 * time.Millisecond}
+	for _, n := range []int{40, 100, 10000} {
+		if got := unbounded.delay(n); got != math.MaxInt64 {
+			t.Errorf("unbounded delay(%d): got: %v; want: %v", n, got, time.Duration(math.MaxInt64))
+		}
+	}
+	b.Jitter = 0.5
+	for k := 0; k < 100; k++ {
+		if got := b.delay(2); got < 150*time.Millisecond || got > 300*time.Millisecond {
+			t.Fatalf("jittered delay(2): got: %v; want in [150ms, 300ms]", got)
+		}
+	}
+}
+
+func TestBackoffFairness(t *testing.T) {
+	const N = 5
+	i := New(WithBackoff(Backoff{Initial: 50 * time.Millisecond}))
+	ctx := context.Background()
+	fail := errors.New("fail")
+	if _, err := i.Do(ctx, func() (interface{}, error) { return nil, fail }); err != fail {
+		t.Fatalf("got error: %v; want: %v", err, fail)
+	}
+	// Callers arriving during the backoff delay line up in order.
+	ran := make(chan int, N)
+	for k := 0; k < N; k++ {
+		k := k
+		go i.Do(ctx, func() (interface{}, error) {
+			ran <- k
+			return "ok", nil
+		})
+		waitFor(t, "queued caller", func() bool {
+			i.mu.Lock()
+			defer i.mu.Unlock()
+			return len(i.queue) == k+1
+		})
+	}
+	if k := <-ran; k != 0 {
+		t.Fatalf("caller %d ran first; want: 0", k)
+	}
+
+	// A caller that gives up leaves the line to the next one.
+	i = New(WithBackoff(Backoff{Initial: 50 * time.Millisecond}))
+	if _, err := i.Do(ctx, func() (interface{}, error) { return nil, fail }); err != fail {
+		t.Fatalf("got error: %v; want: %v", err, fail)
+	}
+	first, cancel := context.WithCancel(ctx)
+	errc := make(chan error, 1)
+	go func() {
+		_, err := i.Do(first, func() (interface{}, error) { return "first", nil })
+		errc <- err
+	}()
+	waitFor(t, "first queued", func() bool {
+		i.mu.Lock()
+		defer i.mu.Unlock()
+		return len(i.queue) == 1
+	})
+	valc := make(chan interface{}, 1)
+	go func() {
+		val, _ := i.Do(ctx, func() (interface{}, error) { return "second", nil })
+		valc <- val
+	}()
+	waitFor(t, "second queued", func() bool {
+		i.mu.Lock()
+		defer i.mu.Unlock()
+		return len(i.queue) == 2
+	})
+	cancel()
+	if err := <-errc; err != context.Canceled {
+		t.Fatalf("first: got error: %v; want: %v", err, context.Canceled)
+	}
+	if val := <-valc; val != "second" {
+		t.Fatalf("got value: %v; want: second", val)
+	}
+}
+
+func TestMaxAttempts(t *testing.T) {
+	i := New(WithMaxAttempts(3))
+	ctx := context.Background()
+	fail := errors.New("fail")
+	var runs uint32
+	fn := func() (interface{}, error) {
+		atomic.AddUint32(&runs, 1)
+		return nil, fail
+	}
+	for k := 0; k < 2; k++ {
+		if _, err := i.Do(ctx, fn); err != fail {
+			t.Fatalf("attempt %d: got error: %v; want: %v", k+1, err, fail)
+		}
+	}
+	for k := 0; k < 3; k++ {
+		_, err := i.Do(ctx, fn)
+		var aerr *AttemptsExhaustedError
+		if !errors.As(err, &aerr) || aerr.Attempts != 3 || !errors.Is(err, ErrAttemptsExhausted) || !errors.Is(err, fail) {
+			t.Fatalf("exhausted: got error: %v; want: %v wrapping %v", err, ErrAttemptsExhausted, fail)
+		}
+	}
+	if n := atomic.LoadUint32(&runs); n != 3 {
+		t.Fatalf("fn ran %d times; want: 3", n)
+	}
+	i.Reset()
+	if _, err := i.Do(ctx, fn); err != fail {
+		t.Fatalf("after reset: got error: %v; want: %v", err, fail)
+	}
+}
+
+func TestJoinedErrors(t *testing.T) {
+	i := New(WithMaxAttempts(3), WithJoinedErrors())
+	ctx := context.Background()
+	errs := []error{errors.New("first"), errors.New("second"), errors.New("third")}
+	var runs uint32
+	fn := func() (interface{}, error) {
+		return nil, errs[atomic.AddUint32(&runs, 1)-1]
+	}
+	for k := 0; k < 2; k++ {
+		if _, err := i.Do(ctx, fn); err != errs[k] {
+			t.Fatalf("attempt %d: got error: %v; want: %v", k+1, err, errs[k])
+		}
+	}
+	_, err := i.Do(ctx, fn)
+	if !errors.Is(err, ErrAttemptsExhausted) {
+		t.Fatalf("exhausted: got error: %v; want: %v", err, ErrAttemptsExhausted)
+	}
+	for _, e := range errs {
+		if !errors.Is(err, e) {
+			t.Fatalf("exhausted: got error: %v; want it to wrap: %v", err, e)
+		}
+	}
+}
+
+func TestTTL(t *testing.T) {
+	const ttl = 20 * time.Millisecond
+	i := New(WithTTL(ttl))
+	ctx := context.Background()
+	var val uint32
+	fn := func() (interface{}, error) {
+		time.Sleep(time.Millisecond)
+		return atomic.AddUint32(&val, 1), nil
+	}
+	testFunc(t, i, "first", ctx, uint32(1), nil, fn)
+	testFunc(t, i, "memoized", ctx, uint32(1), nil, fn)
+	time.Sleep(ttl + 10*time.Millisecond)
+	if _, err := i.GetOrExplain(ctx); err == nil {
+		t.Fatal("expired: GetOrExplain got nil error")
+	}
+	testFunc(t, i, "refreshed", ctx, uint32(2), nil, fn)
+}
+
+func TestErrorTTL(t *testing.T) {
+	const ttl = 20 * time.Millisecond
+	i := New(WithErrorTTL(ttl), WithTTL(time.Hour))
+	ctx := context.Background()
+	var runs uint32
+	notFound := errors.New("not found")
+	fail := func() (interface{}, error) {
+		atomic.AddUint32(&runs, 1)
+		return nil, notFound
+	}
+	testFunc(t, i, "first", ctx, nil, notFound, fail)
+	testFunc(t, i, "cached", ctx, nil, notFound, func() (interface{}, error) {
+		return "ok", nil
+	})
+	if n := atomic.LoadUint32(&runs); n != 1 {
+		t.Fatalf("fn ran %d times; want: 1", n)
+	}
+	if _, ok := i.TryGet(); ok {
+		t.Fatal("cached error: TryGet got true")
+	}
+	time.Sleep(ttl + 10*time.Millisecond)
+	testFunc(t, i, "expired", ctx, "ok", nil, func() (interface{}, error) {
+		return "ok", nil
+	})
+	time.Sleep(ttl + 10*time.Millisecond)
+	testFunc(t, i, "memoized", ctx, "ok", nil, fail)
+
+	// Runs that give up on fn are not cached.
+	i = New(WithErrorTTL(time.Hour), WithRunTimeout(time.Millisecond))
+	release := make(chan struct{})
+	defer close(release)
+	testFunc(t, i, "timeout", ctx, nil, ErrRunTimeout, func() (interface{}, error) {
+		<-release
+		return nil, nil
+	})
+	testFunc(t, i, "after timeout", ctx, "ok", nil, func() (interface{}, error) {
+		return "ok", nil
+	})
+
+	// Cached errors still count as consecutive failures.
+	var attempts []int
+	i = New(WithErrorTTL(time.Millisecond), WithMaxAttempts(2), WithJoinedErrors(), WithHooks(Hooks{
+		OnAttempt: func(attempt int) { attempts = append(attempts, attempt) },
+	}))
+	for k := 0; k < 2; k++ {
+		i.Do(ctx, fail)
+		time.Sleep(5 * time.Millisecond)
+	}
+	_, err := i.Do(ctx, fail)
+	if !errors.Is(err, ErrAttemptsExhausted) {
+		t.Fatalf("after cached errors: got error: %v; want: %v", err, ErrAttemptsExhausted)
+	}
+	var exhausted *AttemptsExhaustedError
+	if errors.As(err, &exhausted); exhausted.Attempts != 2 {
+		t.Fatalf("after cached errors: got %d attempts; want: 2", exhausted.Attempts)
+	}
+	if errs, _ := exhausted.Err.(interface{ Unwrap() []error }); errs == nil || len(errs.Unwrap()) != 2 {
+		t.Fatalf("after cached errors: got joined error: %v; want 2 errors", exhausted.Err)
+	}
+	if want := []int{1, 2}; !reflect.DeepEqual(attempts, want) {
+		t.Fatalf("got attempts: %v; want: %v", attempts, want)
+	}
+}
+
+func TestRefreshAhead(t *testing.T) {
+	const ttl = 200 * time.Millisecond
+	i := New(WithTTL(ttl), WithRefreshAhead(150*time.Millisecond))
+	ctx := context.Background()
+	var val uint32
+	refreshed := make(chan struct{}, 1)
+	fn := func() (interface{}, error) {
+		n := atomic.AddUint32(&val, 1)
+		if n > 1 {
+			refreshed <- struct{}{}
+		}
+		return n, nil
+	}
+	start := time.Now()
+	testFunc(t, i, "first", ctx, uint32(1), nil, fn)
+	time.Sleep(60 * time.Millisecond) // within the refresh window
+	if val, err := i.Do(ctx, fn); val != uint32(1) || err != nil {
+		t.Fatalf("refresh started: got: (%v, %v); want: (1, <nil>)", val, err)
+	}
+	<-refreshed
+	waitFor(t, "refreshed value", func() bool {
+		val, _ := i.Do(ctx, fn)
+		return val == uint32(2)
+	})
+	if d := time.Since(start); d >= ttl {
+		t.Fatalf("refreshed after %v; want before expiration at %v", d, ttl)
+	}
+	if n := atomic.LoadUint32(&val); n != 2 {
+		t.Fatalf("fn ran %d times; want: 2", n)
+	}
+}
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	const ttl = 20 * time.Millisecond
+	i := New(WithTTL(ttl), WithStaleWhileRevalidate(time.Hour))
+	ctx := context.Background()
+	var val uint32
+	release := make(chan struct{})
+	fn := func() (interface{}, error) {
+		if n := atomic.LoadUint32(&val); n > 0 {
+			<-release
+		}
+		return atomic.AddUint32(&val, 1), nil
+	}
+	testFunc(t, i, "first", ctx, uint32(1), nil, fn)
+	time.Sleep(ttl + 10*time.Millisecond)
+	testFunc(t, i, "stale", ctx, uint32(1), nil, fn)
+	close(release)
+	waitFor(t, "revalidated value", func() bool {
+		val, _ := i.Do(ctx, fn)
+		return val == uint32(2)
+	})
+
+	// Past the staleness bound, callers wait for a fresh value.
+	i = New(WithTTL(ttl), WithStaleWhileRevalidate(ttl))
+	val = 0
+	testFunc(t, i, "first bounded", ctx, uint32(1), nil, fn)
+	time.Sleep(2*ttl + 10*time.Millisecond)
+	testFunc(t, i, "too stale", ctx, uint32(2), nil, fn)
+}
+
+func TestHedging(t *testing.T) {
+	i := New(WithHedging(10*time.Millisecond), WithLeakTracking())
+	ctx := context.Background()
+	var calls uint32
+	canceled := make(chan struct{})
+	fn := func(ctx context.Context) (interface{}, error) {
+		if atomic.AddUint32(&calls, 1) == 1 {
+			<-ctx.Done() // the first call hangs until it loses
+			close(canceled)
+			return nil, ctx.Err()
+		}
+		return "hedged", nil
+	}
+	val, err := i.DoContext(ctx, fn)
+	if val != "hedged" || err != nil {
+		t.Fatalf("got: (%v, %v); want: (hedged, <nil>)", val, err)
+	}
+	<-canceled
+	waitLeakedRuns(t, i, 0)
+
+	// The run fails only if both calls fail.
+	i = New(WithHedging(time.Millisecond))
+	calls = 0
+	errFirst, errLast := errors.New("first"), errors.New("last")
+	fn = func(context.Context) (interface{}, error) {
+		if atomic.AddUint32(&calls, 1) == 1 {
+			time.Sleep(20 * time.Millisecond)
+			return nil, errLast
+		}
+		return nil, errFirst
+	}
+	if _, err := i.DoContext(ctx, fn); err != errLast {
+		t.Fatalf("got error: %v; want: %v", err, errLast)
+	}
+	if n := atomic.LoadUint32(&calls); n != 2 {
+		t.Fatalf("got %d calls; want: 2", n)
+	}
+}
+
+func TestHooks(t *testing.T) {
+	var events []string
+	i := New(WithHooks(Hooks{
+		OnAttempt: func(attempt int) {
+			events = append(events, fmt.Sprintf("attempt %d", attempt))
+		},
+		OnSuccess: func(attempt int, d time.Duration) {
+			events = append(events, fmt.Sprintf("success %d", attempt))
+		},
+		OnError: func(attempt int, d time.Duration, err error) {
+			events = append(events, fmt.Sprintf("error %d: %v", attempt, err))
+		},
+	}))
+	ctx := context.Background()
+	fail := errors.New("fail")
+	for k := 0; k < 2; k++ {
+		if _, err := i.Do(ctx, func() (interface{}, error) { return nil, fail }); err != fail {
+			t.Fatalf("failure: got error: %v; want: %v", err, fail)
+		}
+	}
+	if _, err := i.Do(ctx, func() (interface{}, error) { return "ok", nil }); err != nil {
+		t.Fatalf("success: got error: %v", err)
+	}
+	want := []string{"attempt 1", "error 1: fail", "attempt 2", "error 2: fail", "attempt 3", "success 3"}
+	if !reflect.DeepEqual(events, want) {
+		t.Fatalf("got events: %q; want: %q", events, want)
+	}
+
+	// The hooks of several options are all called, in order.
+	events = nil
+	i = New(
+		WithHooks(Hooks{OnSuccess: func(int, time.Duration) { events = append(events, "first") }}),
+		WithHooks(Hooks{OnAttempt: func(int) { events = append(events, "attempt") }}),
+		WithHooks(Hooks{OnSuccess: func(int, time.Duration) { events = append(events, "second") }}),
+	)
+	if _, err := i.Do(ctx, func() (interface{}, error) { return "ok", nil }); err != nil {
+		t.Fatalf("success: got error: %v", err)
+	}
+	want = []string{"attempt", "first", "second"}
+	if !reflect.DeepEqual(events, want) {
+		t.Fatalf("several hooks: got events: %q; want: %q", events, want)
+	}
+}
+
+func TestAttempt(t *testing.T) {
+	if n := Attempt(context.Background()); n != 0 {
+		t.Fatalf("outside of a run: got attempt %d; want: 0", n)
+	}
+	i := new(Init)
+	ctx := context.Background()
+	var attempts []int
+	fail := errors.New("fail")
+	for k := 0; k < 2; k++ {
+		i.DoContext(ctx, func(ctx context.Context) (interface{}, error) {
+			attempts = append(attempts, Attempt(ctx))
+			return nil, fail
+		})
+	}
+	i.DoContext(ctx, func(ctx context.Context) (interface{}, error) {
+		attempts = append(attempts, Attempt(ctx))
+		return "ok", nil
+	})
+	if want := []int{1, 2, 3}; !reflect.DeepEqual(attempts, want) {
+		t.Fatalf("got attempts: %v; want: %v", attempts, want)
+	}
+}
+
+func TestTraceTask(t *testing.T) {
+	var buf bytes.Buffer
+	if err := trace.Start(&buf); err != nil {
+		t.Skipf("tracing unavailable: %v", err)
+	}
+	i := New(WithTraceTask("test-init"))
+	ctx := context.Background()
+	fail := errors.New("fail")
+	if _, err := i.Do(ctx, func() (interface{}, error) { return nil, fail }); err != fail {
+		t.Fatalf("failure: got error: %v; want: %v", err, fail)
+	}
+	testFunc(t, i, "success", ctx, "ok", nil, func() (interface{}, error) {
+		return "ok", nil
+	})
+	trace.Stop()
+	if !bytes.Contains(buf.Bytes(), []byte("test-init")) {
+		t.Fatal("trace does not contain the task")
+	}
+}
+
+func TestInitErrors(t *testing.T) {
+	i := New(WithInitErrors())
+	ctx := context.Background()
+	fail := errors.New("fail")
+	before := time.Now()
+	for k := 1; k <= 2; k++ {
+		_, err := i.Do(ctx, func() (interface{}, error) {
+			time.Sleep(time.Millisecond)
+			return nil, fail
+		})
+		var ierr *InitError
+		if !errors.As(err, &ierr) {
+			t.Fatalf("attempt %d: got error: %#v; want: *InitError", k, err)
+		}
+		if ierr.Attempt != k || ierr.Start.Before(before) || ierr.Elapsed < time.Millisecond || !errors.Is(err, fail) {
+			t.Fatalf("attempt %d: got error: %+v", k, ierr)
+		}
+	}
+	testFunc(t, i, "success", ctx, "ok", nil, func() (interface{}, error) {
+		return "ok", nil
+	})
+}
+
+func TestFinalizer(t *testing.T) {
+	finalized := make(chan interface{}, 10)
+	opts := []Option{WithFinalizer(func(val interface{}) { finalized <- val })}
+	ctx := context.Background()
+	var n uint32
+	fn := func() (interface{}, error) { return atomic.AddUint32(&n, 1), nil }
+	want := func(desc string, val interface{}) {
+		t.Helper()
+		select {
+		case got := <-finalized:
+			if got != val {
+				t.Fatalf("%s: finalized %v; want: %v", desc, got, val)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s: %v not finalized", desc, val)
+		}
+	}
+
+	i := New(opts...)
+	testFunc(t, i, "first", ctx, uint32(1), nil, fn)
+	i.Reset()
+	i.Reset() // nothing left to drop
+	want("reset", uint32(1))
+	testFunc(t, i, "second", ctx, uint32(2), nil, fn)
+	i.Cancel(nil)
+	want("canceled", uint32(2))
+
+	const ttl = 10 * time.Millisecond
+	i = New(append(opts, WithTTL(ttl))...)
+	n = 0
+	testFunc(t, i, "first ttl", ctx, uint32(1), nil, fn)
+	time.Sleep(ttl + 10*time.Millisecond)
+	testFunc(t, i, "expired", ctx, uint32(2), nil, fn)
+	want("expired", uint32(1))
+
+	select {
+	case val := <-finalized:
+		t.Fatalf("finalized %v more than once", val)
+	default:
+	}
+}
+
+// chanLocker is a Locker backed by a channel, standing in for a lock shared
+// by processes.
+type chanLocker chan struct{}
+
+func (l chanLocker) Lock(ctx context.Context, key string) (func(), error) {
+	select {
+	case l <- struct{}{}:
+		return func() { <-l }, nil
+	case <-ctx.Done():
+		return nil, context.Cause(ctx)
+	}
+}
+
+func TestLocker(t *testing.T) {
+	const P = 4 // processes
+	l := make(chanLocker, 1)
+	var holders, builds int32
+	var built atomic.Bool // the work shared by processes, such as a file
+	fn := func() (interface{}, error) {
+		if atomic.AddInt32(&holders, 1) > 1 {
+			t.Error("fn ran while another process held the lock")
+		}
+		defer atomic.AddInt32(&holders, -1)
+		if !built.Load() {
+			time.Sleep(10 * time.Millisecond)
+			atomic.AddInt32(&builds, 1)
+			built.Store(true)
+		}
+		return "index", nil
+	}
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	for p := 0; p < P; p++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			testFunc(t, New(WithLocker(l)), fmt.Sprint("process ", p), ctx, "index", nil, fn)
+		}()
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(&builds); n != 1 {
+		t.Fatalf("built %d times; want: 1", n)
+	}
+
+	// An error from Lock fails the run.
+	fail := errors.New("lock unavailable")
+	i := New(WithLocker(errLocker{fail}))
+	testFunc(t, i, "lock error", ctx, nil, fail, fn)
+}
+
+type errLocker struct{ err error }
+
+func (l errLocker) Lock(ctx context.Context, key string) (func(), error) { return nil, l.err }
+
+// keyLocker is a Locker with a chanLocker per key, counting how many times
+// each key is locked.
+type keyLocker struct {
+	mu    sync.Mutex
+	locks map[string]chanLocker
+	holds map[string]int
+}
+
+func newKeyLocker() *keyLocker {
+	return &keyLocker{locks: make(map[string]chanLocker), holds: make(map[string]int)}
+}
+
+func (l *keyLocker) Lock(ctx context.Context, key string) (func(), error) {
+	l.mu.Lock()
+	c := l.locks[key]
+	if c == nil {
+		c = make(chanLocker, 1)
+		l.locks[key] = c
+	}
+	l.holds[key]++
+	l.mu.Unlock()
+	return c.Lock(ctx, key)
+}
+
+func (l *keyLocker) held(key string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.holds[key]
+}
+
+func TestLockerKeys(t *testing.T) {
+	l := newKeyLocker()
+	g := NewGroup(WithLocker(l))
+	ctx := context.Background()
+
+	// Keys have locks of their own: b runs while a holds its lock.
+	bDone := make(chan struct{})
+	errc := make(chan error, 1)
+	go func() {
+		_, err := g.Do(ctx, "a", func() (interface{}, error) {
+			<-bDone
+			return "a", nil
+		})
+		errc <- err
+	}()
+	if _, err := g.Do(ctx, "b", func() (interface{}, error) { return "b", nil }); err != nil {
+		t.Fatalf("b: unexpected error: %v", err)
+	}
+	close(bDone)
+	if err := <-errc; err != nil {
+		t.Fatalf("a: unexpected error: %v", err)
+	}
+	for _, key := range []string{"a", "b"} {
+		if n := l.held(key); n != 1 {
+			t.Fatalf("locked %q %d times; want: 1", key, n)
+		}
+	}
+}
+
+func TestLockerHedge(t *testing.T) {
+	l := newKeyLocker()
+	i := New(WithLocker(l), WithHedging(time.Millisecond))
+	ctx := context.Background()
+
+	// The hedged call shares the hold of the first call, which keeps the
+	// lock until it returns, even though the run gave up on it.
+	release := make(chan struct{})
+	returned := make(chan struct{})
+	var calls int32
+	val, err := i.Do(ctx, func() (interface{}, error) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			defer close(returned)
+			<-release
+			return "slow", nil
+		}
+		return "hedged", nil
+	})
+	if err != nil || val != "hedged" {
+		t.Fatalf("Do: got (%v, %v); want: (hedged, <nil>)", val, err)
+	}
+	if n := l.held(""); n != 1 {
+		t.Fatalf("locked %d times; want: 1", n)
+	}
+	l.mu.Lock()
+	lock := l.locks[""]
+	l.mu.Unlock()
+	select {
+	case lock <- struct{}{}:
+		t.Fatal("lock released while the first call is in flight")
+	default:
+	}
+	close(release)
+	<-returned
+	select {
+	case lock <- struct{}{}:
+	case <-time.After(time.Second):
+		t.Fatal("lock not released once every call returned")
+	}
+}
@@ -0,0 +1,34 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package syncutil
+
+import (
+	"context"
+	"io"
+)
+
+// MemoizeReader returns a function that lazily opens a stream with open,
+// parses it with parse, and memoizes the parsed value. Concurrent callers
+// share a single open and parse, and a failure is retried by later callers,
+// as with Init.Do. The stream is always closed once parse returns; an error
+// closing it fails the initialization.
+func MemoizeReader(open func() (io.ReadCloser, error), parse func(io.Reader) (interface{}, error)) func(context.Context) (interface{}, error) {
+	i := new(Init)
+	fn := func() (val interface{}, err error) {
+		r, err := open()
+		if err != nil {
+			return nil, err
+		}
+		defer func() {
+			if cerr := r.Close(); cerr != nil && err == nil {
+				val, err = nil, cerr
+			}
+		}()
+		return parse(r)
+	}
+	return func(ctx context.Context) (interface{}, error) {
+		return i.Do(ctx, fn)
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package syncutil
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type trackingReader struct {
+	io.Reader
+	closed *uint32
+}
+
+func (r trackingReader) Close() error {
+	atomic.AddUint32(r.closed, 1)
+	return nil
+}
+
+func TestMemoizeReader(t *testing.T) {
+	var opens, parses, closed uint32
+	fail := errors.New("fail")
+	open := func() (io.ReadCloser, error) {
+		atomic.AddUint32(&opens, 1)
+		return trackingReader{strings.NewReader("data"), &closed}, nil
+	}
+	parse := func(r io.Reader) (interface{}, error) {
+		n := atomic.AddUint32(&parses, 1)
+		time.Sleep(10 * time.Millisecond)
+		if n == 1 {
+			return nil, fail
+		}
+		b, err := ioutil.ReadAll(r)
+		return string(b), err
+	}
+	get := MemoizeReader(open, parse)
+	ctx := context.Background()
+
+	if _, err := get(ctx); err != fail {
+		t.Fatalf("parse failure: got error: %v; want: %v", err, fail)
+	}
+	if n := atomic.LoadUint32(&closed); n != 1 {
+		t.Fatalf("parse failure: reader closed %d times; want: 1", n)
+	}
+
+	const N = 10
+	errc := make(chan error, N)
+	for k := 0; k < N; k++ {
+		go func() {
+			val, err := get(ctx)
+			if err == nil && val != "data" {
+				t.Errorf("got value: %v; want: data", val)
+			}
+			errc <- err
+		}()
+	}
+	for k := 0; k < N; k++ {
+		if err := <-errc; err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+	}
+	if o, p, c := atomic.LoadUint32(&opens), atomic.LoadUint32(&parses), atomic.LoadUint32(&closed); o != 2 || p != 2 || c != 2 {
+		t.Fatalf("got (opens, parses, closes): (%d, %d, %d); want: (2, 2, 2)", o, p, c)
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package singleflight provides the API of golang.org/x/sync/singleflight
+// on top of syncutil.Group, so that existing callers may switch by changing
+// an import path. Unlike the original, the first successful result for a key
+// is memoized until the key is forgotten, and DoContext lets callers give up
+// on a call in flight.
+package singleflight
+
+import (
+	"context"
+	"sync"
+
+	"github.com/abursavich/syncutil"
+)
+
+// Result holds the results of Do, so they can be passed on a channel.
+type Result struct {
+	Val    interface{}
+	Err    error
+	Shared bool
+}
+
+// A Group de-duplicates calls by key. The zero value is ready to use with
+// the default options.
+type Group struct {
+	once sync.Once
+	opts []syncutil.Option
+	g    *syncutil.Group
+}
+
+// NewGroup returns a Group configured with the given options, as with
+// syncutil.NewGroup.
+func NewGroup(opts ...syncutil.Option) *Group {
+	return &Group{opts: opts}
+}
+
+func (g *Group) group() *syncutil.Group {
+	g.once.Do(func() { g.g = syncutil.NewGroup(g.opts...) })
+	return g.g
+}
+
+// Do executes and returns the results of fn, making sure that only one
+// execution is in flight for a given key at a time, and memoizing its
+// results once it succeeds. If a duplicate comes in, the duplicate caller
+// waits for the original to complete and receives the same results. The
+// return value shared reports whether v was memoized or produced by a call
+// started by another caller.
+func (g *Group) Do(key string, fn func() (interface{}, error)) (v interface{}, err error, shared bool) {
+	return g.DoContext(context.Background(), key, fn)
+}
+
+// DoContext is like Do, but it returns the cause of ctx if ctx is done
+// before the results are ready. The call to fn is not affected.
+func (g *Group) DoContext(ctx context.Context, key string, fn func() (interface{}, error)) (v interface{}, err error, shared bool) {
+	v, src, err := g.group().DoShared(ctx, key, func(context.Context) (interface{}, error) {
+		return fn()
+	})
+	return v, err, src != syncutil.SourceRan
+}
+
+// DoChan is like Do but returns a channel that will receive the results
+// when they are ready. The returned channel is never closed.
+func (g *Group) DoChan(key string, fn func() (interface{}, error)) <-chan Result {
+	ch := make(chan Result, 1)
+	go func() {
+		v, err, shared := g.Do(key, fn)
+		ch <- Result{Val: v, Err: err, Shared: shared}
+	}()
+	return ch
+}
+
+// Forget tells the Group to forget about a key, as with syncutil.Group.Forget.
+// Future calls to Do for this key will call fn rather than waiting for an
+// earlier call to complete or returning its memoized results.
+func (g *Group) Forget(key string) {
+	g.group().Forget(key)
+}
@@ -0,0 +1,84 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package singleflight
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDo(t *testing.T) {
+	const N = 10
+	var g Group
+	var calls int32
+	fn := func() (interface{}, error) {
+		atomic.AddInt32(&calls, 1)
+		time.Sleep(10 * time.Millisecond)
+		return "bar", nil
+	}
+	ran := make(chan bool, N)
+	for k := 0; k < N; k++ {
+		go func() {
+			v, err, shared := g.Do("key", fn)
+			if v != "bar" || err != nil {
+				t.Errorf("Do: got: (%v, %v); want: (bar, <nil>)", v, err)
+			}
+			ran <- !shared
+		}()
+	}
+	owners := 0
+	for k := 0; k < N; k++ {
+		if <-ran {
+			owners++
+		}
+	}
+	if owners != 1 {
+		t.Fatalf("got %d unshared results; want: 1", owners)
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Fatalf("fn ran %d times; want: 1", n)
+	}
+
+	// Results are memoized until the key is forgotten.
+	if v, err, shared := g.Do("key", fn); v != "bar" || err != nil || !shared {
+		t.Fatalf("memoized: got: (%v, %v, %v); want: (bar, <nil>, true)", v, err, shared)
+	}
+	g.Forget("key")
+	if r := <-g.DoChan("key", fn); r.Val != "bar" || r.Err != nil || r.Shared {
+		t.Fatalf("DoChan after Forget: got: %+v; want: {bar <nil> false}", r)
+	}
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Fatalf("fn ran %d times; want: 2", n)
+	}
+}
+
+func TestDoErr(t *testing.T) {
+	g := NewGroup()
+	fail := errors.New("fail")
+	if v, err, _ := g.Do("key", func() (interface{}, error) { return nil, fail }); v != nil || err != fail {
+		t.Fatalf("got: (%v, %v); want: (<nil>, %v)", v, err, fail)
+	}
+	if v, err, _ := g.Do("key", func() (interface{}, error) { return "ok", nil }); v != "ok" || err != nil {
+		t.Fatalf("after failure: got: (%v, %v); want: (ok, <nil>)", v, err)
+	}
+}
+
+func TestDoContext(t *testing.T) {
+	var g Group
+	release := make(chan struct{})
+	defer close(release)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err, _ := g.DoContext(ctx, "key", func() (interface{}, error) {
+		<-release
+		return nil, nil
+	})
+	if err != context.DeadlineExceeded {
+		t.Fatalf("got error: %v; want: %v", err, context.DeadlineExceeded)
+	}
+}
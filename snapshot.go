@@ -0,0 +1,112 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package syncutil
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// A Codec encodes the values of a Group for Snapshot and decodes them for
+// Restore.
+type Codec interface {
+	Marshal(val interface{}) ([]byte, error)
+	Unmarshal(data []byte) (interface{}, error)
+}
+
+// JSONCodec is a Codec that encodes values of type T with encoding/json.
+type JSONCodec[T any] struct{}
+
+// Marshal implements Codec.
+func (JSONCodec[T]) Marshal(val interface{}) ([]byte, error) {
+	return json.Marshal(val)
+}
+
+// Unmarshal implements Codec.
+func (JSONCodec[T]) Unmarshal(data []byte) (interface{}, error) {
+	var val T
+	err := json.Unmarshal(data, &val)
+	return val, err
+}
+
+// GobCodec is a Codec that encodes values of type T with encoding/gob.
+type GobCodec[T any] struct{}
+
+// Marshal implements Codec.
+func (GobCodec[T]) Marshal(val interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(val)
+	return buf.Bytes(), err
+}
+
+// Unmarshal implements Codec.
+func (GobCodec[T]) Unmarshal(data []byte) (interface{}, error) {
+	var val T
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&val)
+	return val, err
+}
+
+// A snapshotEntry is a memoized entry of a Group, as written by Snapshot:
+// one JSON object per line.
+type snapshotEntry struct {
+	Key     string    `json:"key"`
+	Value   []byte    `json:"value"`
+	Expires time.Time `json:"expires,omitzero"`
+}
+
+// Snapshot writes the memoized values of g to w, encoded by c, along with
+// their keys and expiration, so that Restore can reload them later, such as
+// when a service restarts. Errors and keys whose run is in flight are left
+// out.
+func (g *Group) Snapshot(w io.Writer, c Codec) error {
+	enc := json.NewEncoder(w)
+	var err error
+	g.t.each(func(key string, i *Init) {
+		if err != nil {
+			return
+		}
+		val, expires, ok := i.memoized()
+		if !ok {
+			return
+		}
+		e := snapshotEntry{Key: key, Expires: expires}
+		if e.Value, err = c.Marshal(val); err != nil {
+			err = fmt.Errorf("syncutil: encoding value of key %q: %w", key, err)
+			return
+		}
+		err = enc.Encode(e)
+	})
+	return err
+}
+
+// Restore reads values written by Snapshot from r, decodes them with c, and
+// memoizes them in g as if fn had returned them, until they expire. Keys
+// that already have an entry in g, and values that have expired, are
+// skipped.
+func (g *Group) Restore(r io.Reader, c Codec) error {
+	dec := json.NewDecoder(r)
+	for {
+		var e snapshotEntry
+		if err := dec.Decode(&e); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("syncutil: reading snapshot: %w", err)
+		}
+		if !e.Expires.IsZero() && !time.Now().Before(e.Expires) {
+			continue
+		}
+		val, err := c.Unmarshal(e.Value)
+		if err != nil {
+			return fmt.Errorf("syncutil: decoding value of key %q: %w", e.Key, err)
+		}
+		i := &Init{cfg: g.cfg}
+		i.store(val, e.Expires)
+		g.t.add(&g.cfg, e.Key, i)
+	}
+}
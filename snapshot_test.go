@@ -0,0 +1,52 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package syncutil
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSnapshot(t *testing.T) {
+	type point struct{ X, Y int }
+	ctx := context.Background()
+	for _, c := range []Codec{JSONCodec[point]{}, GobCodec[point]{}} {
+		g := NewGroup()
+		g.Do(ctx, "a", func() (interface{}, error) { return point{1, 2}, nil })
+		g.DoTTL(ctx, "b", func() (interface{}, time.Duration, error) { return point{3, 4}, time.Hour, nil })
+		g.DoTTL(ctx, "expired", func() (interface{}, time.Duration, error) { return point{5, 6}, time.Nanosecond, nil })
+		g.Do(ctx, "failed", func() (interface{}, error) { return nil, errors.New("fail") })
+		var buf bytes.Buffer
+		if err := g.Snapshot(&buf, c); err != nil {
+			t.Fatalf("%T: Snapshot: got error: %v", c, err)
+		}
+
+		r := NewGroup()
+		r.Do(ctx, "b", func() (interface{}, error) { return point{7, 8}, nil })
+		if err := r.Restore(&buf, c); err != nil {
+			t.Fatalf("%T: Restore: got error: %v", c, err)
+		}
+		fn := func() (interface{}, error) { return "ran", nil }
+		for key, want := range map[string]interface{}{
+			"a":       point{1, 2},
+			"b":       point{7, 8}, // already present
+			"expired": "ran",
+			"failed":  "ran",
+		} {
+			if got, err := r.Do(ctx, key, fn); got != want || err != nil {
+				t.Errorf("%T: %s: got: (%v, %v); want: (%v, <nil>)", c, key, got, err, want)
+			}
+		}
+	}
+
+	g := NewGroup()
+	if err := g.Restore(strings.NewReader("not json"), JSONCodec[int]{}); err == nil {
+		t.Fatal("Restore: got nil error for a corrupt snapshot")
+	}
+}
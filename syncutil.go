@@ -5,120 +5,1226 @@
 // Package syncutil provides additional synchronization primitives on top of
 // those provided by the standard library's sync package.
 //
-// Values containing the types defined in this package should not be copied.
+// The package uses the standard library's context package. Since the Context
+// of golang.org/x/net/context is an alias of context.Context, callers that
+// still use that package keep compiling unchanged. The package requires Go
+// 1.24 or later, for hash/maphash.Comparable and the omitzero option of
+// encoding/json.
+//
+// Values containing the types defined in this package must not be copied
+// after first use. The copylocks check of go vet reports copies, and an Init
+// used after it was copied panics.
 package syncutil
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"runtime/debug"
+	"runtime/trace"
 	"sync"
 	"sync/atomic"
-
-	"golang.org/x/net/context"
+	"time"
 )
 
-const (
-	uninitialized = iota
-	initialized
-	finished
-)
+// ErrMaxFailures is returned by DoMaxFailures once fn has failed the
+// maximum number of times.
+var ErrMaxFailures = errors.New("syncutil: maximum failures reached")
+
+// ErrRunTimeout is returned when a run of fn does not complete within the
+// timeout set by WithRunTimeout or WithIsolatedRun.
+var ErrRunTimeout = errors.New("syncutil: run timed out")
+
+// ErrNotStarted is returned by GetOrExplain if no run of fn has started.
+var ErrNotStarted = errors.New("syncutil: initialization not started")
+
+// ErrClosed is returned by calls to an Init that has been closed.
+var ErrClosed = errors.New("syncutil: Init closed")
+
+// ErrInProgress is returned by GetOrExplain while a run of fn is in flight.
+var ErrInProgress = errors.New("syncutil: initialization in progress")
+
+// ErrAttemptsExhausted is matched by errors returned once the attempts
+// allowed by WithMaxAttempts have failed. Use errors.Is to test for it.
+var ErrAttemptsExhausted = errors.New("syncutil: attempts exhausted")
+
+// An AttemptsExhaustedError is memoized once the attempts allowed by
+// WithMaxAttempts have failed. It wraps the error of the last attempt, or the
+// errors of all attempts joined by errors.Join if i was created with
+// WithJoinedErrors.
+type AttemptsExhaustedError struct {
+	Attempts int   // number of failed attempts
+	Err      error // error of the last attempt, or of all attempts
+}
+
+func (e *AttemptsExhaustedError) Error() string {
+	return fmt.Sprintf("syncutil: attempts exhausted after %d failures: %v", e.Attempts, e.Err)
+}
+
+// Unwrap returns the error of the last attempt.
+func (e *AttemptsExhaustedError) Unwrap() error { return e.Err }
+
+// Is reports whether target is ErrAttemptsExhausted.
+func (e *AttemptsExhaustedError) Is(target error) bool { return target == ErrAttemptsExhausted }
+
+// An InitError describes a failed run of fn. It is returned instead of the
+// error of fn if i was created with WithInitErrors.
+type InitError struct {
+	Attempt int           // attempt number of the run; see Hooks
+	Start   time.Time     // start time of the run
+	Elapsed time.Duration // duration of the run
+	Err     error         // error of the run
+}
+
+func (e *InitError) Error() string {
+	return fmt.Sprintf("syncutil: attempt %d failed after %v: %v", e.Attempt, e.Elapsed, e.Err)
+}
+
+// Unwrap returns the error of the run.
+func (e *InitError) Unwrap() error { return e.Err }
+
+// A PanicError is returned when fn panics and the panic is recovered.
+type PanicError struct {
+	Value interface{} // value passed to panic
+	Stack []byte      // stack trace of the panicking goroutine
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("syncutil: panic in fn: %v\n\n%s", e.Value, e.Stack)
+}
+
+// attemptKey is the context key of the attempt number of a run.
+type attemptKey struct{}
+
+// Attempt returns the attempt number of the run whose context ctx is or
+// derives from, as passed to Hooks.OnAttempt, or 0 if ctx does not come from
+// a run. It lets fn, or a wrapper of fn, tell a retry from a first attempt.
+func Attempt(ctx context.Context) int {
+	n, _ := ctx.Value(attemptKey{}).(int)
+	return n
+}
+
+// initCopied is the panic message of an Init used after it was copied.
+const initCopied = "syncutil: Init copied after first use"
 
 // Init is an object that will perform exactly one successful action.
 type Init struct {
-	mu    sync.Mutex
-	state uint32
-	done  chan struct{}
-	wake  chan struct{}
-	errc  chan chan error
-	val   interface{}
+	noCopy  noCopy
+	checker copyChecker
+
+	cfg     config
+	mu      sync.Mutex
+	gen     *generation // current generation; guarded by mu
+	memo    atomic.Pointer[generation]
+	cur     *attempt      // run in flight, if any; guarded by mu
+	retry   *time.Timer   // pending backoff delay, if any; guarded by mu
+	queue   []uint64      // tickets of callers waiting to start a run, oldest first; guarded by mu
+	turn    chan struct{} // closed when a queued caller may proceed; guarded by mu
+	tickets uint64        // last ticket handed out; guarded by mu
+	ckpt    interface{}   // partial value kept by DoCheckpoint; guarded by mu
+
+	runStart     time.Time     // start of the in-flight run; guarded by mu
+	lastErr      error         // error of the last failed run; guarded by mu
+	lastDuration time.Duration // duration of the last run; guarded by mu
+
+	failures uint32        // failed calls to fn made by DoMaxFailures
+	leaked   int32         // abandoned runs, if tracking leaks
+	waiters  int32         // callers registered with the in-flight run
+	runs     uint64        // calls to fn
+	failed   int           // consecutive failed runs; owned by the runner or mu
+	errs     []error       // errors of the failed runs, with WithJoinedErrors; as failed
+	canceled error         // cause passed to Cancel; guarded by mu
+	calls    int           // calls to fn that have not returned; guarded by mu
+	drained  chan struct{} // closed once calls drops to zero; guarded by mu
+
+	watchers map[chan interface{}]struct{} // channels returned by Watch; guarded by mu
+
+	warm    atomic.Bool // set once a value is first memoized
+	dropped bool        // dropped by its Group; guarded by mu
+	lockKey string      // key passed to the Locker, set by its Group
+}
+
+// A generation holds the results memoized by an Init between resets.
+type generation struct {
+	done chan struct{} // closed once the results are memoized
+	val  interface{}
+	err  error // memoized with WithPermanentErrors
+
+	expires    time.Time // zero if the results never expire
+	refreshAt  time.Time // zero if the results are not refreshed ahead
+	refreshing uint32    // set once a refresh run starts
+	retired    uint32    // set once the value is passed to the finalizer
+	negative   bool      // err is memoized by WithErrorTTL
+
+	lastErr error             // error of the last run, if it failed; guarded by mu
+	cancel  func(cause error) // cancels the run's context; guarded by mu
+}
+
+// An attempt is a run of fn and the callers waiting on it.
+type attempt struct {
+	gen     *generation   // generation to publish successful results to
+	done    chan struct{} // closed once the run is over
+	abandon chan struct{} // closed once all callers give up, with WithCancelOnAbandon
+	err     error         // error of a failed run; set before done is closed
+
+	// guarded by Init.mu
+	waiters   int  // callers waiting on the run
+	finished  bool // the outcome is decided; callers may no longer join
+	abandoned bool // all callers gave up, counted as leaked
 }
 
 // Do de-duplicates concurrent calls to the function fn and memoizes the
 // first result for which a nil error is returned. Calls to Do may return
-// before fn is completed if their context ctx is canceled.
+// before fn is completed if their context ctx is canceled. A caller's
+// context only bounds its own wait; it never shortens fn's execution for
+// other callers.
+//
+// Once a call to fn returns, all pending callers share the results, down to
+// the identical error value. Once a call to fn returns with a nil error
+// value, all future callers share the results. Callers that arrive too late
+// to join a failed run line up for the next one, which the caller that has
+// waited longest starts.
 //
-// Once a call to fn returns, all pending callers share the results. Once a
-// call to fn returns with a nil error value, all future callers share the
-// results.
+// Once the outcome of a run has been published, it takes precedence over the
+// caller's context: a memoized value is returned even if ctx is done, and
+// so is the error of a failed run, such as ErrRunTimeout or a value vetoed by
+// WithPreCommit. The cause of ctx, as reported by context.Cause, is returned
+// only if ctx is done before then.
 //
 // The function fn runs in its own goroutine and may complete in the
-// background after Do returns. Panics in fn are not recovered.
+// background after Do returns, unless i was created with WithForegroundRun.
+// Panics in fn are not recovered unless i was created with WithRecover or
+// WithIsolatedRun.
 func (i *Init) Do(ctx context.Context, fn func() (interface{}, error)) (interface{}, error) {
-	if s := atomic.LoadUint32(&i.state); s == finished { // fast path
-		return i.val, nil
-	} else if s == uninitialized { // lazy initialization
-		i.mu.Lock()
-		if i.state == uninitialized {
-			i.done = make(chan struct{})
-			i.wake = make(chan struct{}, 1)
-			i.errc = make(chan chan error)
-			i.wake <- struct{}{}
-			atomic.StoreUint32(&i.state, initialized)
+	val, _, err := i.do(ctx, i.cold(), func(context.Context) (interface{}, error) {
+		return fn()
+	})
+	return val, err
+}
+
+// MustDo is like Do, but panics if fn fails, or if ctx is done before the
+// results are ready. It is intended for program-lifetime singletons, such as
+// compiled regular expressions or parsed templates, whose initialization only
+// fails because of a programming error. The panic value is an error wrapping
+// the error of Do. As with Do, a failed run is not memoized, so a later call
+// to MustDo runs fn again.
+func (i *Init) MustDo(ctx context.Context, fn func() (interface{}, error)) interface{} {
+	val, err := i.Do(ctx, fn)
+	if err != nil {
+		panic(fmt.Errorf("syncutil: MustDo: %w", err))
+	}
+	return val
+}
+
+// DoContext is like Do, but passes a context to fn. The context carries the
+// values of the ctx of the caller that started the run, but not its
+// deadline or cancellation: the run is shared with other callers and may
+// complete after that caller gives up. The context is canceled when the run
+// is over, including when WithIsolatedRun detaches the run from fn.
+func (i *Init) DoContext(ctx context.Context, fn func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	val, _, err := i.do(ctx, i.cold(), fn)
+	return val, err
+}
+
+// A Source describes where the results of a call to DoShared came from.
+type Source int
+
+const (
+	// SourceMemoized means that the results were already published when
+	// the call was made.
+	SourceMemoized Source = iota
+	// SourceJoined means that the call waited on a run started by another
+	// caller and shared its results, or gave up before it could join one.
+	SourceJoined
+	// SourceRan means that the call started the run of fn.
+	SourceRan
+)
+
+func (s Source) String() string {
+	switch s {
+	case SourceMemoized:
+		return "memoized"
+	case SourceJoined:
+		return "joined"
+	case SourceRan:
+		return "ran"
+	}
+	return fmt.Sprintf("Source(%d)", int(s))
+}
+
+// DoShared is like DoContext, but also reports whether the results were
+// memoized, shared with a run started by another caller, or produced by a run
+// that this call started. A call that starts a run reports SourceRan even if
+// it returns before the run is over.
+func (i *Init) DoShared(ctx context.Context, fn func(ctx context.Context) (interface{}, error)) (interface{}, Source, error) {
+	return i.do(ctx, i.cold(), fn)
+}
+
+// A Result holds the results of a call to DoChan.
+type Result struct {
+	Val interface{}
+	Err error
+}
+
+// DoChan is like DoContext, but returns a channel that receives the results
+// once they are ready, so that callers can select on them alongside other
+// events. The channel is buffered, so it need not be read. If results are
+// memoized, they are ready immediately; otherwise DoChan waits for them in a
+// new goroutine.
+func (i *Init) DoChan(ctx context.Context, fn func(ctx context.Context) (interface{}, error)) <-chan Result {
+	c := make(chan Result, 1)
+	if g := i.serve(ctx, fn); g != nil {
+		c <- Result{g.val, g.err}
+		return c
+	}
+	go func() {
+		val, _, err := i.do(ctx, i.cold(), fn)
+		c <- Result{val, err}
+	}()
+	return c
+}
+
+// Wait is like DoContext, but only reports whether initialization succeeded.
+// It is useful in startup code that needs the resource to exist but has no
+// use for it. Wait always waits for the results, even if i was created with
+// WithColdStartDefault.
+func (i *Init) Wait(ctx context.Context, fn func(ctx context.Context) (interface{}, error)) error {
+	_, _, err := i.do(ctx, false, fn)
+	return err
+}
+
+// do implements DoContext and reports the source of the results. If cold, it
+// serves the cold start default instead of waiting for a run.
+func (i *Init) do(ctx context.Context, cold bool, fn func(context.Context) (interface{}, error)) (interface{}, Source, error) {
+	if g := i.serve(ctx, fn); g != nil { // fast path; see run
+		return g.val, SourceMemoized, g.err
+	}
+	i.generation() // lazy initialization
+
+	// join
+	src := SourceJoined
+	var ticket uint64 // set while queued to start a run
+	i.mu.Lock()
+	g := i.gen
+	a := i.cur
+	for a == nil || a.finished {
+		if isClosed(g.done) {
+			i.dequeue(ticket)
+			i.mu.Unlock()
+			return g.val, SourceMemoized, g.err
+		}
+		if a == nil && i.retry == nil && (len(i.queue) == 0 || i.queue[0] == ticket) {
+			i.dequeue(ticket)
+			src = SourceRan
+			if cold {
+				// Like Start, the run counts a waiter that never gives up,
+				// since the caller does not wait for it.
+				i.start(ctx, fn, 1)
+				i.mu.Unlock()
+				return i.cfg.coldStartVal, src, nil
+			}
+			a = i.start(ctx, fn, 0)
+			break
+		}
+		if cold { // serve the default instead of waiting for a run to start
+			i.dequeue(ticket)
+			i.mu.Unlock()
+			return i.cfg.coldStartVal, src, nil
 		}
+		// Wait in line, so that the oldest caller starts the next run.
+		if ticket == 0 {
+			i.tickets++
+			ticket = i.tickets
+			i.queue = append(i.queue, ticket)
+		}
+		if i.turn == nil {
+			i.turn = make(chan struct{})
+		}
+		turn := i.turn
 		i.mu.Unlock()
+		select {
+		case <-g.done:
+		case <-ctx.Done():
+			i.mu.Lock()
+			i.dequeue(ticket)
+			i.mu.Unlock()
+			if isClosed(g.done) { // a memoized value takes precedence
+				return g.val, SourceMemoized, g.err
+			}
+			return nil, src, context.Cause(ctx)
+		case <-turn:
+		}
+		i.mu.Lock()
+		g = i.gen
+		a = i.cur
 	}
-
-	errc := make(chan error)
-	// register
-	select {
-	case <-i.done:
-		return i.val, nil
-	case <-ctx.Done():
-		return nil, ctx.Err()
-	case <-i.wake:
-		go i.run(errc, fn)
-	case i.errc <- errc:
-		// registered
+	i.dequeue(ticket)
+	if cold && src == SourceJoined { // serve the default instead of joining
+		i.mu.Unlock()
+		return i.cfg.coldStartVal, src, nil
+	}
+	if a.abandoned {
+		a.abandoned = false
+		atomic.AddInt32(&i.leaked, -1)
 	}
+	a.waiters++
+	atomic.StoreInt32(&i.waiters, int32(a.waiters))
+	i.mu.Unlock()
+
 	// await result
 	select {
-	case <-i.done:
-		return i.val, nil
-	case err := <-errc:
-		return nil, err
+	case <-g.done:
+		return g.val, src, g.err
+	case <-a.done:
+		return i.outcome(g, a, src)
 	case <-ctx.Done():
 		// quiting
 	}
-	// unregister
+	// leave
+	i.mu.Lock()
+	if a.finished { // too late to leave; the outcome takes precedence
+		i.mu.Unlock()
+		select {
+		case <-g.done:
+			return g.val, src, g.err
+		case <-a.done:
+			return i.outcome(g, a, src)
+		}
+	}
+	a.waiters--
+	atomic.StoreInt32(&i.waiters, int32(a.waiters))
+	abandoned := a.waiters == 0
+	if abandoned {
+		if i.cfg.cancelOnAbandon {
+			a.finished = true
+			close(a.abandon)
+		} else if i.cfg.trackLeaks {
+			a.abandoned = true
+			atomic.AddInt32(&i.leaked, 1)
+		}
+	}
+	i.mu.Unlock()
+	if abandoned {
+		i.logf("all callers gave up on run")
+	}
+	return nil, src, context.Cause(ctx)
+}
+
+// cold reports whether calls should serve the cold start default: only until
+// a value is first memoized.
+func (i *Init) cold() bool {
+	return i.cfg.coldStart && !i.warm.Load()
+}
+
+// dequeue removes ticket, if any, from the queue of callers waiting to start a
+// run. i.mu must be held.
+func (i *Init) dequeue(ticket uint64) {
+	if ticket == 0 {
+		return
+	}
+	for k, t := range i.queue {
+		if t == ticket {
+			i.queue = append(i.queue[:k], i.queue[k+1:]...)
+			if k == 0 {
+				i.signal() // let the next in line proceed
+			}
+			return
+		}
+	}
+}
+
+// signal wakes the callers waiting in the queue. i.mu must be held.
+func (i *Init) signal() {
+	if i.turn != nil {
+		close(i.turn)
+		i.turn = nil
+	}
+}
+
+// outcome returns the results of the finished attempt a for generation g.
+func (i *Init) outcome(g *generation, a *attempt, src Source) (interface{}, Source, error) {
+	if isClosed(g.done) {
+		return g.val, src, g.err
+	}
+	return nil, src, a.err
+}
+
+// start starts a run of fn with the given number of waiters. i.mu must be
+// held, and no run may be in flight.
+func (i *Init) start(ctx context.Context, fn func(context.Context) (interface{}, error), waiters int) *attempt {
+	a := &attempt{gen: i.gen, done: make(chan struct{}), waiters: waiters}
+	if i.cfg.cancelOnAbandon {
+		a.abandon = make(chan struct{})
+	}
+	i.cur = a
+	i.signal() // let queued callers join
+	atomic.StoreInt32(&i.waiters, int32(waiters))
+	go i.run(ctx, a, fn)
+	return a
+}
+
+func isClosed(c <-chan struct{}) bool {
 	select {
-	case <-i.done:
-		return i.val, nil
-	case err := <-errc:
-		return nil, err
-	case i.errc <- errc:
-		return nil, ctx.Err()
+	case <-c:
+		return true
+	default:
+		return false
 	}
 }
 
-// run lazily runs in its own goroutine on demand
-func (i *Init) run(errc chan error, fn func() (interface{}, error)) {
-	c := make(chan error)
-	go func() {
-		var err error
-		i.val, err = fn()
-		c <- err
-	}()
+// Start starts a run of fn in the background and returns without waiting for
+// it, so that an expensive value can be warmed before it is needed. Later
+// calls to Do join the run or share its results. Start does nothing if
+// results are memoized, a run is already in flight, or the next run is
+// delayed by WithBackoff. The context passed to fn is as with DoContext.
+func (i *Init) Start(ctx context.Context, fn func(ctx context.Context) (interface{}, error)) {
+	if i.serve(ctx, fn) != nil {
+		return
+	}
+	i.generation() // lazy initialization
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if isClosed(i.gen.done) || i.cur != nil || i.retry != nil {
+		return
+	}
+	// The run counts a waiter that never gives up, so it is never abandoned.
+	i.start(ctx, fn, 1)
+}
 
-	m := map[chan error]struct{}{
-		errc: struct{}{}, // runner starts registered
+// generation returns the current generation, initializing i if necessary.
+func (i *Init) generation() *generation {
+	i.checker.check(initCopied)
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.gen == nil { // lazy initialization
+		i.gen = &generation{done: make(chan struct{})}
 	}
-	for {
-		select {
-		case err := <-c:
+	return i.gen
+}
+
+// Cancel cancels i for good: the context of the run in flight, if any, is
+// canceled with cause, and all current and future calls to Do return cause
+// in place of their results. A nil cause means context.Canceled. Results of
+// the canceled run are discarded; with WithForegroundRun, a value it returns
+// is passed to the cleanup function. Calls to Cancel after the first have no
+// effect.
+func (i *Init) Cancel(cause error) {
+	if cause == nil {
+		cause = context.Canceled
+	}
+	g := i.generation() // lazy initialization
+	i.mu.Lock()
+	if i.canceled != nil {
+		i.mu.Unlock()
+		return
+	}
+	i.canceled = cause
+	old := i.memo.Load()
+	g = i.gen
+	select {
+	case <-g.done: // results are published; replace them
+		g = &generation{done: make(chan struct{})}
+		i.gen = g
+	default:
+		if g.cancel != nil {
+			g.cancel(cause)
+		}
+	}
+	g.val, g.err = nil, cause
+	i.memo.Store(g)
+	close(g.done)
+	i.unwatch()
+	i.mu.Unlock()
+	i.retire(old)
+}
+
+// Close tears i down for good: it cancels i with ErrClosed, as with Cancel,
+// so that all current and future calls to Do return ErrClosed, and it passes
+// the memoized value, if any, to the finalizer set by WithFinalizer. Close
+// then waits for calls to fn in flight to return, or for ctx to be done, in
+// which case it returns the cause of ctx. A value returned by a canceled call
+// is discarded; to release it, use WithForegroundRun.
+func (i *Init) Close(ctx context.Context) error {
+	i.Cancel(ErrClosed)
+	i.mu.Lock()
+	if i.calls == 0 {
+		i.mu.Unlock()
+		return nil
+	}
+	if i.drained == nil {
+		i.drained = make(chan struct{})
+	}
+	drained := i.drained
+	i.mu.Unlock()
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	}
+}
+
+// Reset drops the memoized value, if any, so that the next call to Do runs
+// fn again. It is safe to call concurrently with Do. Callers that have
+// already observed the memoized value keep it. A run in flight is not
+// affected: its callers receive its results, which are memoized as usual.
+// Reset also clears the failures counted by DoMaxFailures, even if no value
+// is memoized. Reset has no effect once i is canceled.
+func (i *Init) Reset() {
+	i.mu.Lock()
+	g := i.memo.Load()
+	if i.canceled == nil {
+		atomic.StoreUint32(&i.failures, 0)
+	}
+	switch {
+	case i.canceled != nil || g == nil:
+		g = nil
+	case i.gen != g: // a refresh run is in flight
+		i.memo.Store(nil)
+	default:
+		i.reset()
+	}
+	i.mu.Unlock()
+	i.retire(g)
+}
+
+// drop is called when i is removed from a Group or a similar table. It
+// resets i and makes a run in flight, if any, pass its value to the
+// finalizer as soon as its callers have it, since later callers use another
+// Init.
+func (i *Init) drop() {
+	i.mu.Lock()
+	i.dropped = true
+	i.mu.Unlock()
+	i.Reset()
+}
+
+// reset starts a new generation after a memoized one. i.mu must be held.
+func (i *Init) reset() {
+	i.memo.Store(nil)
+	i.gen = &generation{done: make(chan struct{})}
+	i.failed = 0
+	i.errs = nil
+}
+
+// store memoizes val as if a run had returned it, without calling fn. It
+// expires at the given time or, if that is zero, as set by WithTTL.
+func (i *Init) store(val interface{}, expires time.Time) {
+	i.mu.Lock()
+	g := &generation{done: make(chan struct{}), val: val, expires: expires}
+	if expires.IsZero() && i.cfg.ttl > 0 {
+		g.expires = time.Now().Add(i.cfg.ttl)
+	}
+	i.gen = g
+	i.memo.Store(g)
+	close(g.done)
+	i.warm.Store(true)
+	i.notify(val)
+	i.mu.Unlock()
+}
+
+// load returns the memoized generation, if it has not expired.
+func (i *Init) load() *generation {
+	i.checker.check(initCopied)
+	g := i.memo.Load()
+	if g == nil || g.expires.IsZero() || time.Now().Before(g.expires) {
+		return g
+	}
+	return nil
+}
+
+// serve returns the memoized generation, if it may still be served, and
+// starts a background refresh of it when one is due.
+func (i *Init) serve(ctx context.Context, fn func(context.Context) (interface{}, error)) *generation {
+	i.checker.check(initCopied)
+	g := i.memo.Load()
+	if g == nil || g.expires.IsZero() {
+		return g
+	}
+	switch now := time.Now(); {
+	case now.Before(g.expires):
+		if !g.refreshAt.IsZero() && now.After(g.refreshAt) {
+			i.refresh(ctx, g, fn)
+		}
+	case now.Before(g.expires.Add(i.cfg.maxStale)): // stale while revalidating
+		i.refresh(ctx, g, fn)
+	default:
+		i.expire(g)
+		return nil
+	}
+	return g
+}
+
+// expire drops the expired generation g, if it is still memoized.
+func (i *Init) expire(g *generation) {
+	i.mu.Lock()
+	if i.memo.Load() != g { // already replaced
+		i.mu.Unlock()
+		return
+	}
+	if i.gen == g {
+		failed, errs := i.failed, i.errs
+		i.reset()
+		if g.negative { // the next run carries on counting failures
+			i.failed, i.errs = failed, errs
+			i.gen.lastErr = g.lastErr
+		}
+	} else { // let callers join the refresh run
+		i.memo.Store(nil)
+	}
+	i.mu.Unlock()
+	i.retire(g)
+}
+
+// retire passes the value of the dropped generation g, if any, to the
+// finalizer set by WithFinalizer. It is called without holding i.mu, and it
+// calls the finalizer at most once per generation.
+func (i *Init) retire(g *generation) {
+	if g == nil || g.err != nil || i.cfg.finalizer == nil {
+		return
+	}
+	if atomic.CompareAndSwapUint32(&g.retired, 0, 1) {
+		i.cfg.finalizer(g.val)
+	}
+}
+
+// refresh starts a background run of fn for the next generation while g is
+// still served, unless one has already been started.
+func (i *Init) refresh(ctx context.Context, g *generation, fn func(context.Context) (interface{}, error)) {
+	if !atomic.CompareAndSwapUint32(&g.refreshing, 0, 1) {
+		return
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.memo.Load() != g || i.gen != g {
+		return
+	}
+	// The new run replaces g in memo when it succeeds. It counts a waiter
+	// that never gives up, so it is never abandoned.
+	i.gen = &generation{done: make(chan struct{})}
+	i.start(ctx, fn, 1)
+}
+
+// DoMaxFailures is like Do, but gives up once calls to fn made by
+// DoMaxFailures have failed a total of k times. Failures are counted across
+// all calls to DoMaxFailures on i. Once the limit is reached, DoMaxFailures
+// returns ErrMaxFailures without calling fn again until Reset.
+func (i *Init) DoMaxFailures(ctx context.Context, k int, fn func() (interface{}, error)) (interface{}, error) {
+	if i.load() == nil && i.maxFailures(k) {
+		return nil, ErrMaxFailures
+	}
+	return i.Do(ctx, func() (interface{}, error) {
+		if i.maxFailures(k) { // another run failed since the check above
+			return nil, ErrMaxFailures
+		}
+		val, err := fn()
+		if err != nil {
+			atomic.AddUint32(&i.failures, 1)
+		}
+		return val, err
+	})
+}
+
+func (i *Init) maxFailures(k int) bool {
+	return int64(atomic.LoadUint32(&i.failures)) >= int64(k)
+}
+
+// DoInto is like Do, but stores the memoized value in the variable pointed
+// to by dst instead of returning it. It returns an error without calling Do
+// if dst is not a non-nil pointer, and an error if the value cannot be
+// assigned to the variable.
+func (i *Init) DoInto(ctx context.Context, dst interface{}, fn func() (interface{}, error)) error {
+	ptr := reflect.ValueOf(dst)
+	if ptr.Kind() != reflect.Ptr || ptr.IsNil() {
+		return fmt.Errorf("syncutil: DoInto destination must be a non-nil pointer, not %T", dst)
+	}
+	val, err := i.Do(ctx, fn)
+	if err != nil {
+		return err
+	}
+	elem := ptr.Elem()
+	if val == nil {
+		switch elem.Kind() {
+		case reflect.Chan, reflect.Func, reflect.Interface, reflect.Map, reflect.Ptr, reflect.Slice:
+			elem.Set(reflect.Zero(elem.Type()))
+			return nil
+		}
+		return fmt.Errorf("syncutil: cannot assign nil to %s", elem.Type())
+	}
+	v := reflect.ValueOf(val)
+	if !v.Type().AssignableTo(elem.Type()) {
+		return fmt.Errorf("syncutil: cannot assign %T to %s", val, elem.Type())
+	}
+	elem.Set(v)
+	return nil
+}
+
+// DoCheckpoint is like Do, but for initializations that proceed in stages.
+// The function fn is called repeatedly, each time with the partial value prev
+// returned by the previous call, until it reports that it is done. The first
+// call receives a nil prev. If fn fails, the last partial value is kept and
+// passed to fn when a later call retries, so the initialization resumes
+// rather than restarts.
+//
+// The context passed to fn is the context of the run, as with DoContext.
+func (i *Init) DoCheckpoint(ctx context.Context, fn func(ctx context.Context, prev interface{}) (interface{}, bool, error)) (interface{}, error) {
+	val, _, err := i.do(ctx, i.cold(), func(ctx context.Context) (interface{}, error) {
+		i.mu.Lock()
+		prev := i.ckpt
+		i.mu.Unlock()
+		for {
+			val, done, err := fn(ctx, prev)
 			if err != nil {
-				for errc := range m { // broadcast error
-					errc <- err
+				return nil, err
+			}
+			i.mu.Lock()
+			if done {
+				i.ckpt = nil
+			} else {
+				i.ckpt = val
+			}
+			i.mu.Unlock()
+			if done {
+				return val, nil
+			}
+			prev = val
+		}
+	})
+	return val, err
+}
+
+// memoized returns the memoized value and its expiration, if any.
+func (i *Init) memoized() (val interface{}, expires time.Time, ok bool) {
+	if g := i.load(); g != nil && g.err == nil {
+		return g.val, g.expires, true
+	}
+	return nil, time.Time{}, false
+}
+
+// TryGet returns the memoized value and true, without blocking and without
+// starting a run. It returns false if no value is memoized, including when
+// the memoized results are an error or have expired.
+func (i *Init) TryGet() (interface{}, bool) {
+	if g := i.load(); g != nil && g.err == nil {
+		return g.val, true
+	}
+	return nil, false
+}
+
+// Done returns a channel that is closed once results are memoized, so that
+// callers can select on initialization alongside other events. The results
+// may be an error memoized by WithPermanentErrors, WithMaxAttempts, or
+// WithErrorTTL. After the results are reset or expire, Done returns a new
+// channel. Results served stale by WithStaleWhileRevalidate have not expired
+// yet.
+func (i *Init) Done() <-chan struct{} {
+	if g := i.load(); g != nil {
+		return g.done
+	}
+	if g := i.memo.Load(); g != nil && !time.Now().Before(g.expires.Add(i.cfg.maxStale)) {
+		i.expire(g) // as serve would, so the expired generation is not current
+	}
+	return i.generation().done
+}
+
+// Stats describes the state of an Init.
+type Stats struct {
+	Attempts     uint64        // calls to fn, as reported by RunCount
+	Waiters      int           // callers waiting on the run in flight
+	LastErr      error         // error of the last failed run, if any
+	LastDuration time.Duration // duration of the last completed run
+	Finished     bool          // whether results are memoized
+}
+
+// Stats returns a snapshot of the state of i, for debugging and monitoring.
+func (i *Init) Stats() Stats {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return Stats{
+		Attempts:     atomic.LoadUint64(&i.runs),
+		Waiters:      int(atomic.LoadInt32(&i.waiters)),
+		LastErr:      i.lastErr,
+		LastDuration: i.lastDuration,
+		Finished:     i.load() != nil,
+	}
+}
+
+// GetOrExplain returns the memoized value if there is one. Otherwise, it
+// returns an error explaining why not, without starting a run: ErrNotStarted
+// if fn has not been called since i was created, reset, or its results
+// expired, an error wrapping ErrInProgress that reports how long the
+// in-flight run has been going, or an error wrapping the error of the last
+// failed run since then. If ctx is done, it returns context.Cause(ctx).
+func (i *Init) GetOrExplain(ctx context.Context) (interface{}, error) {
+	if g := i.load(); g != nil {
+		return g.val, g.err
+	}
+	if ctx.Err() != nil {
+		return nil, context.Cause(ctx)
+	}
+	i.mu.Lock()
+	start := i.runStart
+	var lastErr error
+	if i.gen != nil {
+		lastErr = i.gen.lastErr
+	}
+	i.mu.Unlock()
+	if g := i.load(); g != nil { // finished meanwhile
+		return g.val, g.err
+	}
+	switch {
+	case !start.IsZero():
+		return nil, fmt.Errorf("%w (running for %v)", ErrInProgress, time.Since(start).Round(time.Millisecond))
+	case lastErr != nil:
+		return nil, fmt.Errorf("syncutil: initialization failed: %w", lastErr)
+	}
+	return nil, ErrNotStarted
+}
+
+// RunCount returns the number of times i has called an fn over its lifetime,
+// including calls that failed or were abandoned. A high count relative to
+// the number of successful initializations signals churn.
+func (i *Init) RunCount() uint64 {
+	return atomic.LoadUint64(&i.runs)
+}
+
+// LeakedRuns returns the number of runs that have been abandoned by all of
+// their callers and whose call to fn has not yet returned. An fn that ignores
+// its callers giving up and never returns shows up here indefinitely.
+// It always returns zero unless i was created with WithLeakTracking.
+func (i *Init) LeakedRuns() int {
+	return int(atomic.LoadInt32(&i.leaked))
+}
+
+// run lazily runs in its own goroutine on demand
+func (i *Init) run(ctx context.Context, a *attempt, fn func(context.Context) (interface{}, error)) {
+	g := a.gen
+	i.mu.Lock()
+	began := time.Now()
+	i.runStart = began
+	attempt := i.failed + 1
+	i.mu.Unlock()
+	i.logf("run started (attempt %d)", attempt)
+	if h := i.cfg.hooks.OnAttempt; h != nil {
+		h(attempt)
+	}
+	ctx, cancelCause := context.WithCancelCause(context.WithoutCancel(ctx))
+	cancel := func() { cancelCause(nil) }
+	defer cancel()
+	i.mu.Lock()
+	if i.canceled == nil {
+		g.cancel = cancelCause
+	} else { // canceled before the run got here
+		cancelCause(i.canceled)
+	}
+	i.mu.Unlock()
+	ctx = context.WithValue(ctx, attemptKey{}, attempt)
+	if name := i.cfg.traceTask; name != "" {
+		var task *trace.Task
+		ctx, task = trace.NewTask(ctx, name)
+		defer task.End()
+	}
+	release := func() {} // called once every call of fn has returned
+	if l := i.cfg.locker; l != nil {
+		// The calls of the run, hedged ones included, share a single hold of
+		// the lock, taken by whichever starts first.
+		lock := sync.OnceValues(func() (func(), error) { return l.Lock(ctx, i.lockKey) })
+		call := fn
+		fn = func(ctx context.Context) (interface{}, error) {
+			if _, err := lock(); err != nil {
+				return nil, err
+			}
+			return call(ctx)
+		}
+		release = func() {
+			if unlock, err := lock(); err == nil {
+				unlock()
+			}
+		}
+	}
+	c := make(chan result, 2) // buffered so detached calls can finish
+	pending := 0              // calls of fn that have not returned
+	start := func() {
+		pending++
+		go func() {
+			val, err := i.call(ctx, fn)
+			r := result{val: val, err: err}
+			if e, ok := val.(expiring); ok {
+				r.val, r.ttl = e.val, e.ttl
+			}
+			c <- r
+		}()
+	}
+	start()
+	var timeout <-chan time.Time
+	if d := i.cfg.runTimeout; d > 0 {
+		t := time.NewTimer(d)
+		defer t.Stop()
+		timeout = t.C
+	}
+	var hedge <-chan time.Time
+	if d := i.cfg.hedgeDelay; d > 0 {
+		t := time.NewTimer(d)
+		defer t.Stop()
+		hedge = t.C
+	}
+	discard := func(r result) {
+		if r.err == nil && i.cfg.cleanup != nil {
+			i.cfg.cleanup(r.val)
+		}
+	}
+	detach := func() { // give up on pending calls and discard their results
+		cancel()
+		n := pending
+		pending = 0
+		if n == 0 {
+			return
+		}
+		if i.cfg.trackLeaks {
+			atomic.AddInt32(&i.leaked, int32(n))
+		}
+		go func() {
+			for ; n > 0; n-- {
+				r := <-c
+				i.logf("discarded call returned (attempt %d): %v", attempt, r.err)
+				if i.cfg.trackLeaks {
+					atomic.AddInt32(&i.leaked, -1)
 				}
-				i.wake <- struct{}{} // signal next runner
-				return
+				discard(r)
+			}
+			release()
+		}()
+	}
+
+	var r result
+	abandonedRun := false
+wait:
+	for {
+		select {
+		case r = <-c:
+			pending--
+			if r.err != nil && pending > 0 {
+				continue // wait for the hedged call
+			}
+			if pending > 0 {
+				detach() // cancel the losing call
+			} else {
+				release()
 			}
-			atomic.StoreUint32(&i.state, finished)
-			close(i.done)
+			break wait
+		case <-hedge:
+			hedge = nil
+			start()
+		case <-g.done: // canceled by Cancel
+			i.mu.Lock()
+			a.finished = true
+			i.cur = nil
+			i.signal()
+			atomic.StoreInt32(&i.waiters, 0)
+			i.mu.Unlock()
+			close(a.done)
+			detach()
 			return
-		case errc := <-i.errc:
-			if _, ok := m[errc]; ok { // unregister
-				delete(m, errc)
-				continue
+		case <-timeout:
+			r = result{err: ErrRunTimeout, detached: true}
+			detach()
+			break wait
+		case <-a.abandon:
+			r = result{err: context.Canceled, detached: true}
+			abandonedRun = true
+			detach()
+			break wait
+		}
+	}
+
+	// Decide the outcome. From here on, callers may neither join nor leave.
+	i.mu.Lock()
+	if a.finished && !abandonedRun { // the last caller gave up meanwhile
+		discard(r)
+		r = result{err: context.Canceled, detached: true}
+		abandonedRun = true
+		detach()
+	}
+	background := a.waiters == 0 && !abandonedRun
+	a.finished = true
+	if a.abandoned {
+		a.abandoned = false
+		atomic.AddInt32(&i.leaked, -1)
+	}
+	atomic.StoreInt32(&i.waiters, 0)
+	i.mu.Unlock()
+	if background {
+		i.logf("run completed in background (attempt %d)", attempt)
+	}
+
+	if r.err == nil && i.cfg.preCommit != nil {
+		r.err = i.cfg.preCommit(r.val)
+	}
+	if r.err != nil && i.cfg.initErrors {
+		r.err = &InitError{Attempt: attempt, Start: began, Elapsed: time.Since(began), Err: r.err}
+	}
+	memoize := r.err == nil || i.cfg.permanentErrors && !r.detached
+	if r.err != nil && !abandonedRun {
+		i.failed++
+		if i.cfg.joinErrors {
+			i.errs = append(i.errs, r.err)
+		}
+		if n := i.cfg.maxAttempts; n > 0 && i.failed >= n {
+			err := r.err
+			if i.cfg.joinErrors {
+				err = errors.Join(i.errs...)
 			}
-			m[errc] = struct{}{} // register
+			r.err = &AttemptsExhaustedError{Attempts: i.failed, Err: err}
+			i.errs = nil
+			memoize = true
+		}
+	}
+	// With WithErrorTTL, other errors are memoized until they expire.
+	negative := !memoize && !r.detached && i.cfg.errorTTL > 0
+	i.mu.Lock()
+	d := time.Since(i.runStart)
+	i.lastDuration = d
+	i.runStart = time.Time{}
+	if r.err != nil {
+		i.lastErr = r.err
+	}
+	g.lastErr = r.err
+	i.mu.Unlock()
+	if r.err != nil {
+		i.logf("run failed after %v (attempt %d): %v", d, attempt, r.err)
+		if i.cfg.traceTask != "" {
+			trace.Log(ctx, "syncutil.error", r.err.Error())
+		}
+	} else {
+		i.logf("run succeeded after %v (attempt %d)", d, attempt)
+	}
+	if h := i.cfg.hooks.OnError; h != nil && r.err != nil {
+		h(attempt, d, r.err)
+	}
+	if h := i.cfg.hooks.OnSuccess; h != nil && r.err == nil {
+		h(attempt, d)
+	}
+
+	if !memoize && !negative {
+		// Broadcast the error to the waiting callers and let the next
+		// caller start a new run, possibly after a backoff delay.
+		a.err = r.err
+		backoff := !abandonedRun && i.cfg.backoff != nil
+		var delay time.Duration
+		if backoff {
+			delay = i.cfg.backoff.delay(i.failed)
+			i.logf("retrying after %v", delay)
+		}
+		i.mu.Lock()
+		i.cur = nil
+		i.signal()
+		if backoff {
+			// The timer func locks i.mu, so it observes retry.
+			var retry *time.Timer
+			retry = time.AfterFunc(delay, func() {
+				i.mu.Lock()
+				if i.retry == retry {
+					i.retry = nil
+					i.signal()
+				}
+				i.mu.Unlock()
+			})
+			i.retry = retry
+		}
+		i.mu.Unlock()
+		close(a.done)
+		return
+	}
+	if r.err == nil {
+		i.failed = 0
+		i.errs = nil
+	}
+	// Publish the results. The write to g happens before g is stored
+	// in memo, which happens before any load that observes it, so the
+	// fast paths may read g without further synchronization.
+	// Closing done likewise publishes it to the slow paths.
+	i.mu.Lock()
+	i.cur = nil
+	i.signal()
+	if i.canceled != nil {
+		i.mu.Unlock()
+		close(a.done)
+		discard(r)
+		return
+	}
+	g.val, g.err = r.val, r.err
+	ttl := i.cfg.ttl
+	if r.ttl > 0 {
+		ttl = r.ttl
+	}
+	if negative {
+		ttl = i.cfg.errorTTL
+		g.negative = true
+	}
+	if ttl > 0 {
+		g.expires = time.Now().Add(ttl)
+		if i.cfg.refreshAhead > 0 && !negative {
+			g.refreshAt = g.expires.Add(-i.cfg.refreshAhead)
+		}
+	}
+	old := i.memo.Load() // refreshed
+	i.memo.Store(g)
+	close(g.done)
+	if g.err == nil {
+		i.warm.Store(true)
+		i.notify(g.val)
+	}
+	dropped := i.dropped
+	i.mu.Unlock()
+	close(a.done)
+	i.retire(old)
+	if dropped { // its callers have the value, and no one else will
+		i.retire(g)
+	}
+}
+
+type result struct {
+	val      interface{}
+	err      error
+	ttl      time.Duration // overrides WithTTL, if positive
+	detached bool          // the run gave up on fn
+}
+
+// An expiring value is returned by fn to memoize val for ttl, as with
+// Group.DoTTL. It is unwrapped as soon as fn returns.
+type expiring struct {
+	val interface{}
+	ttl time.Duration
+}
+
+// call calls fn with the configured isolation.
+func (i *Init) call(ctx context.Context, fn func(context.Context) (interface{}, error)) (val interface{}, err error) {
+	i.mu.Lock()
+	i.calls++
+	i.mu.Unlock()
+	defer func() {
+		i.mu.Lock()
+		if i.calls--; i.calls == 0 && i.drained != nil {
+			close(i.drained)
+			i.drained = nil
 		}
+		i.mu.Unlock()
+	}()
+	if i.cfg.recover {
+		defer func() {
+			if r := recover(); r != nil {
+				val, err = nil, &PanicError{Value: r, Stack: debug.Stack()}
+			}
+		}()
+	}
+	if i.cfg.lockOSThread {
+		lockOSThread()
+		defer unlockOSThread()
+	}
+	atomic.AddUint64(&i.runs, 1)
+	if i.cfg.traceTask != "" {
+		defer trace.StartRegion(ctx, "syncutil.call").End()
 	}
+	return fn(ctx)
 }
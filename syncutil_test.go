@@ -5,12 +5,14 @@
 package syncutil
 
 import (
+	"context"
 	"errors"
+	"reflect"
+	"runtime"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
-
-	"golang.org/x/net/context"
 )
 
 func TestInit(t *testing.T) {
@@ -48,6 +50,873 @@ func TestInitContext(t *testing.T) {
 	})
 }
 
+func TestInitReset(t *testing.T) {
+	i := new(Init)
+	ctx := context.Background()
+	i.Reset() // no-op before initialization
+	var val uint32
+	fn := func() (interface{}, error) {
+		return atomic.AddUint32(&val, 1), nil
+	}
+	testFunc(t, i, "first success", ctx, uint32(1), nil, fn)
+	testFunc(t, i, "memoized", ctx, uint32(1), nil, fn)
+	i.Reset()
+	testFunc(t, i, "after reset", ctx, uint32(2), nil, fn)
+	i.Reset()
+	i.Reset() // no-op without a memoized value
+	testFunc(t, i, "after double reset", ctx, uint32(3), nil, fn)
+}
+
+func TestInitResetInFlight(t *testing.T) {
+	i := new(Init)
+	ctx := context.Background()
+	started := make(chan struct{})
+	release := make(chan struct{})
+	resc := make(chan interface{})
+	go func() {
+		val, _ := i.Do(ctx, func() (interface{}, error) {
+			close(started)
+			<-release
+			return "in flight", nil
+		})
+		resc <- val
+	}()
+	<-started
+	i.Reset() // does not affect the run in flight
+	close(release)
+	if val := <-resc; val != "in flight" {
+		t.Fatalf("waiting caller: got: %v; want: in flight", val)
+	}
+	testFunc(t, i, "memoized", ctx, "in flight", nil, func() (interface{}, error) {
+		return "new", nil
+	})
+}
+
+func TestInitResetConcurrent(t *testing.T) {
+	i := new(Init)
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	for k := 0; k < 4; k++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < 1000; n++ {
+				if _, err := i.Do(ctx, func() (interface{}, error) {
+					return n, nil
+				}); err != nil {
+					t.Errorf("got error: %v", err)
+					return
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for n := 0; n < 1000; n++ {
+				i.Reset()
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestInitDoContext(t *testing.T) {
+	i := New(WithIsolatedRun(10 * time.Millisecond))
+	type key struct{}
+	ctx, cancel := context.WithTimeout(context.WithValue(context.Background(), key{}, "value"), time.Hour)
+	defer cancel()
+	runCtx := make(chan context.Context, 1)
+	_, err := i.DoContext(ctx, func(ctx context.Context) (interface{}, error) {
+		if _, ok := ctx.Deadline(); ok {
+			t.Error("run context has the caller's deadline")
+		}
+		if v := ctx.Value(key{}); v != "value" {
+			t.Errorf("got run context value: %v; want: value", v)
+		}
+		runCtx <- ctx
+		<-ctx.Done() // canceled when the run is detached
+		return nil, ctx.Err()
+	})
+	if err != ErrRunTimeout {
+		t.Fatalf("got error: %v; want: %v", err, ErrRunTimeout)
+	}
+	if err := (<-runCtx).Err(); err != context.Canceled {
+		t.Fatalf("got run context error: %v; want: %v", err, context.Canceled)
+	}
+
+	// The run context is independent of the caller that started the run.
+	i = new(Init)
+	ctx, cancel = context.WithCancel(context.Background())
+	started := make(chan struct{})
+	release := make(chan struct{})
+	fn := func(ctx context.Context) (interface{}, error) {
+		close(started)
+		<-release
+		return "ok", ctx.Err()
+	}
+	errc := make(chan error)
+	go func() {
+		_, err := i.DoContext(ctx, fn)
+		errc <- err
+	}()
+	<-started
+	cancel()
+	if err := <-errc; err != context.Canceled {
+		t.Fatalf("leader: got error: %v; want: %v", err, context.Canceled)
+	}
+	close(release)
+	if val, err := i.DoContext(context.Background(), fn); val != "ok" || err != nil {
+		t.Fatalf("follower: got: (%v, %v); want: (ok, <nil>)", val, err)
+	}
+}
+
+func TestInitStart(t *testing.T) {
+	i := new(Init)
+	ctx := context.Background()
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var runs uint32
+	fn := func(ctx context.Context) (interface{}, error) {
+		if atomic.AddUint32(&runs, 1) == 1 {
+			close(started)
+		}
+		<-release
+		return "ok", nil
+	}
+	i.Start(ctx, fn) // does not block
+	<-started
+	i.Start(ctx, fn) // run already in flight
+	resc := make(chan interface{})
+	go func() {
+		val, _ := i.DoContext(ctx, fn)
+		resc <- val
+	}()
+	close(release)
+	if val := <-resc; val != "ok" {
+		t.Fatalf("got: %v; want: ok", val)
+	}
+	i.Start(ctx, fn) // results memoized
+	if n := atomic.LoadUint32(&runs); n != 1 {
+		t.Fatalf("fn ran %d times; want: 1", n)
+	}
+}
+
+func TestInitWait(t *testing.T) {
+	i := new(Init)
+	ctx := context.Background()
+	fail := errors.New("fail")
+	if err := i.Wait(ctx, func(context.Context) (interface{}, error) {
+		return nil, fail
+	}); err != fail {
+		t.Fatalf("failure: got error: %v; want: %v", err, fail)
+	}
+	if err := i.Wait(ctx, func(context.Context) (interface{}, error) {
+		return "ok", nil
+	}); err != nil {
+		t.Fatalf("success: got error: %v", err)
+	}
+	if val, err := i.Do(ctx, nil); val != "ok" || err != nil {
+		t.Fatalf("memoized: got: (%v, %v); want: (ok, <nil>)", val, err)
+	}
+}
+
+func TestInitTryGet(t *testing.T) {
+	i := new(Init)
+	if val, ok := i.TryGet(); ok {
+		t.Fatalf("uninitialized: got: (%v, true); want: (<nil>, false)", val)
+	}
+	ctx := context.Background()
+	started := make(chan struct{})
+	release := make(chan struct{})
+	go i.Do(ctx, func() (interface{}, error) {
+		close(started)
+		<-release
+		return "ok", nil
+	})
+	<-started
+	if val, ok := i.TryGet(); ok {
+		t.Fatalf("running: got: (%v, true); want: (<nil>, false)", val)
+	}
+	close(release)
+	i.Wait(ctx, nil)
+	if val, ok := i.TryGet(); val != "ok" || !ok {
+		t.Fatalf("memoized: got: (%v, %v); want: (ok, true)", val, ok)
+	}
+
+	p := New(WithPermanentErrors())
+	p.Do(ctx, func() (interface{}, error) { return nil, errors.New("fail") })
+	if val, ok := p.TryGet(); ok {
+		t.Fatalf("memoized error: got: (%v, true); want: (<nil>, false)", val)
+	}
+}
+
+func TestInitDone(t *testing.T) {
+	i := new(Init)
+	done := i.Done()
+	select {
+	case <-done:
+		t.Fatal("uninitialized: done is closed")
+	default:
+	}
+	ctx := context.Background()
+	i.Do(ctx, func() (interface{}, error) { return nil, errors.New("fail") })
+	select {
+	case <-done:
+		t.Fatal("failed: done is closed")
+	default:
+	}
+	go i.Do(ctx, func() (interface{}, error) { return "ok", nil })
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for done")
+	}
+	if d := i.Done(); d != done {
+		t.Fatal("memoized: Done returned a different channel")
+	}
+	i.Reset()
+	select {
+	case <-i.Done():
+		t.Fatal("reset: done is closed")
+	default:
+	}
+
+	i = New(WithTTL(10 * time.Millisecond))
+	i.Do(ctx, func() (interface{}, error) { return "ok", nil })
+	time.Sleep(20 * time.Millisecond)
+	if _, ok := i.TryGet(); ok {
+		t.Fatal("expired: TryGet got true")
+	}
+	select {
+	case <-i.Done():
+		t.Fatal("expired: done is closed")
+	default:
+	}
+}
+
+func TestInitStats(t *testing.T) {
+	i := new(Init)
+	if got, want := i.Stats(), (Stats{}); got != want {
+		t.Fatalf("uninitialized: got stats %+v; want: %+v", got, want)
+	}
+	ctx := context.Background()
+	fail := errors.New("fail")
+	i.Do(ctx, func() (interface{}, error) {
+		time.Sleep(10 * time.Millisecond)
+		return nil, fail
+	})
+	if s := i.Stats(); s.Attempts != 1 || s.LastErr != fail || s.LastDuration < 10*time.Millisecond || s.Finished {
+		t.Fatalf("failed: got stats %+v", s)
+	}
+
+	const N = 3
+	release := make(chan struct{})
+	errc := make(chan error, N)
+	for k := 0; k < N; k++ {
+		go func() {
+			_, err := i.Do(ctx, func() (interface{}, error) {
+				<-release
+				return "ok", nil
+			})
+			errc <- err
+		}()
+	}
+	waitFor(t, "waiters", func() bool { return i.Stats().Waiters == N })
+	close(release)
+	for k := 0; k < N; k++ {
+		<-errc
+	}
+	if s := i.Stats(); s.Attempts != 2 || s.Waiters != 0 || s.LastErr != fail || !s.Finished {
+		t.Fatalf("finished: got stats %+v", s)
+	}
+}
+
+func TestInitDoChan(t *testing.T) {
+	i := new(Init)
+	ctx := context.Background()
+	release := make(chan struct{})
+	var runs uint32
+	fn := func(context.Context) (interface{}, error) {
+		atomic.AddUint32(&runs, 1)
+		<-release
+		return "ok", nil
+	}
+	c1, c2 := i.DoChan(ctx, fn), i.DoChan(ctx, fn)
+	select {
+	case r := <-c1:
+		t.Fatalf("got early result: %+v", r)
+	case <-time.After(10 * time.Millisecond):
+	}
+	close(release)
+	for _, c := range []<-chan Result{c1, c2, i.DoChan(ctx, fn)} {
+		if r := <-c; r.Val != "ok" || r.Err != nil {
+			t.Fatalf("got result: %+v; want: {ok <nil>}", r)
+		}
+	}
+	if n := atomic.LoadUint32(&runs); n != 1 {
+		t.Fatalf("fn ran %d times; want: 1", n)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	hang := make(chan struct{})
+	defer close(hang)
+	c := new(Init).DoChan(ctx, func(ctx context.Context) (interface{}, error) {
+		cancel()
+		<-hang
+		return nil, nil
+	})
+	if r := <-c; r.Err != context.Canceled {
+		t.Fatalf("canceled: got result: %+v; want error: %v", r, context.Canceled)
+	}
+}
+
+func TestInitDoShared(t *testing.T) {
+	const N = 10
+	i := new(Init)
+	ctx := context.Background()
+	release := make(chan struct{})
+	fn := func(context.Context) (interface{}, error) {
+		<-release
+		return "ok", nil
+	}
+	srcc := make(chan Source, N)
+	for k := 0; k < N; k++ {
+		go func() {
+			val, src, err := i.DoShared(ctx, fn)
+			if val != "ok" || err != nil {
+				t.Errorf("got: (%v, %v); want: (ok, <nil>)", val, err)
+			}
+			srcc <- src
+		}()
+	}
+	for atomic.LoadInt32(&i.waiters) < N {
+		runtime.Gosched()
+	}
+	close(release)
+	counts := make(map[Source]int)
+	for k := 0; k < N; k++ {
+		counts[<-srcc]++
+	}
+	if counts[SourceRan] != 1 || counts[SourceJoined] != N-1 {
+		t.Fatalf("got sources: %v; want: 1 ran and %d joined", counts, N-1)
+	}
+	if _, src, _ := i.DoShared(ctx, fn); src != SourceMemoized {
+		t.Fatalf("memoized: got source: %v; want: %v", src, SourceMemoized)
+	}
+}
+
+func TestInitCause(t *testing.T) {
+	cause := errors.New("shutting down")
+	ctx, cancel := context.WithCancelCause(context.Background())
+	hang := make(chan struct{})
+	defer close(hang)
+	_, err := new(Init).DoContext(ctx, func(context.Context) (interface{}, error) {
+		cancel(cause)
+		<-hang
+		return nil, nil
+	})
+	if err != cause {
+		t.Fatalf("got error: %v; want: %v", err, cause)
+	}
+}
+
+func TestInitCancel(t *testing.T) {
+	const N = 10
+	cleaned := make(chan interface{}, 1)
+	i := New(WithForegroundRun(func(val interface{}) { cleaned <- val }))
+	ctx := context.Background()
+	cause := errors.New("shutting down")
+	fnCause := make(chan error, 1)
+	fn := func(ctx context.Context) (interface{}, error) {
+		<-ctx.Done()
+		fnCause <- context.Cause(ctx)
+		return "late", nil
+	}
+	errc := make(chan error, N)
+	for k := 0; k < N; k++ {
+		go func() {
+			_, err := i.DoContext(ctx, fn)
+			errc <- err
+		}()
+	}
+	for atomic.LoadInt32(&i.waiters) < N {
+		runtime.Gosched()
+	}
+	i.Cancel(cause)
+	for k := 0; k < N; k++ {
+		if err := <-errc; err != cause {
+			t.Fatalf("waiter: got error: %v; want: %v", err, cause)
+		}
+	}
+	if err := <-fnCause; err != cause {
+		t.Fatalf("fn: got cause: %v; want: %v", err, cause)
+	}
+	if val := <-cleaned; val != "late" {
+		t.Fatalf("cleaned up: %v; want: late", val)
+	}
+	i.Reset()
+	testFunc(t, i, "after cancel", ctx, nil, cause, func() (interface{}, error) {
+		return "ok", nil
+	})
+
+	// Memoized results are replaced, too.
+	i = new(Init)
+	testFunc(t, i, "memoized", ctx, "ok", nil, func() (interface{}, error) {
+		return "ok", nil
+	})
+	i.Cancel(nil)
+	i.Cancel(cause) // no effect
+	testFunc(t, i, "canceled", ctx, nil, context.Canceled, func() (interface{}, error) {
+		return "ok", nil
+	})
+
+	// Cancel reaches a run that has started but not yet set up its context.
+	i = New(WithHooks(Hooks{OnAttempt: func(int) { i.Cancel(cause) }}))
+	go i.DoContext(ctx, fn)
+	select {
+	case err := <-fnCause:
+		if err != cause {
+			t.Fatalf("early cancel: fn got cause: %v; want: %v", err, cause)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("early cancel: fn's context was never canceled")
+	}
+}
+
+func TestInitClose(t *testing.T) {
+	finalized := make(chan interface{}, 1)
+	i := New(WithFinalizer(func(val interface{}) { finalized <- val }))
+	ctx := context.Background()
+	testFunc(t, i, "memoized", ctx, "ok", nil, func() (interface{}, error) {
+		return "ok", nil
+	})
+	if err := i.Close(ctx); err != nil {
+		t.Fatalf("close: got error: %v", err)
+	}
+	if val := <-finalized; val != "ok" {
+		t.Fatalf("finalized %v; want: ok", val)
+	}
+	testFunc(t, i, "closed", ctx, nil, ErrClosed, func() (interface{}, error) {
+		return "ok", nil
+	})
+
+	// Close waits for a call in flight to return.
+	i = new(Init)
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var returned int32
+	go i.DoContext(ctx, func(ctx context.Context) (interface{}, error) {
+		close(started)
+		<-ctx.Done()
+		<-release
+		atomic.StoreInt32(&returned, 1)
+		return nil, nil
+	})
+	<-started
+	short, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if err := i.Close(short); err != context.DeadlineExceeded {
+		t.Fatalf("close: got error: %v; want: %v", err, context.DeadlineExceeded)
+	}
+	close(release)
+	if err := i.Close(ctx); err != nil {
+		t.Fatalf("close: got error: %v", err)
+	}
+	if atomic.LoadInt32(&returned) == 0 {
+		t.Fatal("close returned before fn")
+	}
+}
+
+func TestInitMustDo(t *testing.T) {
+	i := new(Init)
+	ctx := context.Background()
+	fail := errors.New("fail")
+	func() {
+		defer func() {
+			err, _ := recover().(error)
+			if !errors.Is(err, fail) {
+				t.Fatalf("got panic: %v; want an error wrapping: %v", err, fail)
+			}
+		}()
+		i.MustDo(ctx, func() (interface{}, error) { return nil, fail })
+	}()
+	if val := i.MustDo(ctx, func() (interface{}, error) { return "ok", nil }); val != "ok" {
+		t.Fatalf("got: %v; want: ok", val)
+	}
+}
+
+func TestInitMixedDeadlines(t *testing.T) {
+	i := new(Init)
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var runs uint32
+	fn := func() (interface{}, error) {
+		atomic.AddUint32(&runs, 1)
+		close(started)
+		<-release
+		return "done", nil
+	}
+
+	// The impatient caller starts the run and gives up while fn is running.
+	impatient, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	errc := make(chan error)
+	go func() {
+		_, err := i.Do(impatient, fn)
+		errc <- err
+	}()
+	<-started
+
+	patient, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	type result struct {
+		val interface{}
+		err error
+	}
+	resc := make(chan result)
+	go func() {
+		val, err := i.Do(patient, fn)
+		resc <- result{val, err}
+	}()
+
+	if err := <-errc; err != context.DeadlineExceeded {
+		t.Fatalf("impatient caller: got error: %v; want: %v", err, context.DeadlineExceeded)
+	}
+	close(release)
+	if r := <-resc; r.val != "done" || r.err != nil {
+		t.Fatalf("patient caller: got: (%v, %v); want: (done, <nil>)", r.val, r.err)
+	}
+	if n := atomic.LoadUint32(&runs); n != 1 {
+		t.Fatalf("fn ran %d times; want: 1", n)
+	}
+}
+
+func TestInitMaxFailures(t *testing.T) {
+	i := new(Init)
+	ctx := context.Background()
+	err := errors.New("fail")
+	var runs uint32
+	fail := func() (interface{}, error) {
+		atomic.AddUint32(&runs, 1)
+		return nil, err
+	}
+	for k := 1; k <= 3; k++ {
+		if _, got := i.DoMaxFailures(ctx, 3, fail); got != err {
+			t.Fatalf("call %d: got error: %v; want: %v", k, got, err)
+		}
+	}
+	for k := 0; k < 3; k++ {
+		if _, got := i.DoMaxFailures(ctx, 3, fail); got != ErrMaxFailures {
+			t.Fatalf("after max failures: got error: %v; want: %v", got, ErrMaxFailures)
+		}
+	}
+	if n := atomic.LoadUint32(&runs); n != 3 {
+		t.Fatalf("fn ran %d times; want: 3", n)
+	}
+	val, got := i.DoMaxFailures(ctx, 4, func() (interface{}, error) {
+		return "ok", nil
+	})
+	if val != "ok" || got != nil {
+		t.Fatalf("higher limit: got: (%v, %v); want: (ok, <nil>)", val, got)
+	}
+
+	// Reset clears the count, even if nothing is memoized.
+	i = new(Init)
+	if _, got := i.DoMaxFailures(ctx, 1, fail); got != err {
+		t.Fatalf("first failure: got error: %v; want: %v", got, err)
+	}
+	i.Reset()
+	val, got = i.DoMaxFailures(ctx, 1, func() (interface{}, error) {
+		return "ok", nil
+	})
+	if val != "ok" || got != nil {
+		t.Fatalf("after Reset: got: (%v, %v); want: (ok, <nil>)", val, got)
+	}
+}
+
+func TestInitDoInto(t *testing.T) {
+	i := new(Init)
+	ctx := context.Background()
+	fn := func() (interface{}, error) { return 42, nil }
+
+	var n int
+	if err := i.DoInto(ctx, &n, fn); err != nil || n != 42 {
+		t.Fatalf("int: got: (%v, %v); want: (42, <nil>)", n, err)
+	}
+	var v interface{}
+	if err := i.DoInto(ctx, &v, fn); err != nil || v != 42 {
+		t.Fatalf("interface: got: (%v, %v); want: (42, <nil>)", v, err)
+	}
+	var s string
+	if err := i.DoInto(ctx, &s, fn); err == nil {
+		t.Fatalf("type mismatch: got: %q; want error", s)
+	}
+	if err := i.DoInto(ctx, n, fn); err == nil {
+		t.Fatal("non-pointer destination: got nil error")
+	}
+	fail := errors.New("fail")
+	if err := new(Init).DoInto(ctx, &n, func() (interface{}, error) {
+		return nil, fail
+	}); err != fail {
+		t.Fatalf("failure: got error: %v; want: %v", err, fail)
+	}
+}
+
+func TestInitCheckpoint(t *testing.T) {
+	i := new(Init)
+	ctx := context.Background()
+	err := errors.New("fail")
+	var calls []interface{}
+	fail := true
+	fn := func(ctx context.Context, prev interface{}) (interface{}, bool, error) {
+		calls = append(calls, prev)
+		switch prev {
+		case nil:
+			return "stage 1", false, nil
+		case "stage 1":
+			if fail {
+				fail = false
+				return nil, false, err
+			}
+			return "stage 2", true, nil
+		}
+		return nil, false, errors.New("unexpected checkpoint")
+	}
+	if _, got := i.DoCheckpoint(ctx, fn); got != err {
+		t.Fatalf("first attempt: got error: %v; want: %v", got, err)
+	}
+	if val, got := i.DoCheckpoint(ctx, fn); val != "stage 2" || got != nil {
+		t.Fatalf("resumed attempt: got: (%v, %v); want: (stage 2, <nil>)", val, got)
+	}
+	want := []interface{}{nil, "stage 1", "stage 1"}
+	if len(calls) != len(want) {
+		t.Fatalf("got calls with prev: %v; want: %v", calls, want)
+	}
+	for k := range want {
+		if calls[k] != want[k] {
+			t.Fatalf("got calls with prev: %v; want: %v", calls, want)
+		}
+	}
+}
+
+func TestInitGetOrExplain(t *testing.T) {
+	i := new(Init)
+	ctx := context.Background()
+	if _, err := i.GetOrExplain(ctx); err != ErrNotStarted {
+		t.Fatalf("not started: got error: %v; want: %v", err, ErrNotStarted)
+	}
+	cause := errors.New("shutting down")
+	canceled, cancel := context.WithCancelCause(ctx)
+	cancel(cause)
+	if _, err := i.GetOrExplain(canceled); err != cause {
+		t.Fatalf("canceled: got error: %v; want: %v", err, cause)
+	}
+
+	fail := errors.New("fail")
+	if _, err := i.Do(ctx, func() (interface{}, error) { return nil, fail }); err != fail {
+		t.Fatalf("got error: %v; want: %v", err, fail)
+	}
+	if _, err := i.GetOrExplain(ctx); !errors.Is(err, fail) {
+		t.Fatalf("failed: got error: %v; want error wrapping: %v", err, fail)
+	}
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		i.Do(ctx, func() (interface{}, error) {
+			close(started)
+			<-release
+			return "ok", nil
+		})
+		close(done)
+	}()
+	<-started
+	if _, err := i.GetOrExplain(ctx); !errors.Is(err, ErrInProgress) {
+		t.Fatalf("running: got error: %v; want error wrapping: %v", err, ErrInProgress)
+	}
+	close(release)
+	<-done
+	if val, err := i.GetOrExplain(ctx); val != "ok" || err != nil {
+		t.Fatalf("finished: got: (%v, %v); want: (ok, <nil>)", val, err)
+	}
+
+	// Earlier failures are not reported once the results are dropped.
+	i.Reset()
+	if _, err := i.GetOrExplain(ctx); err != ErrNotStarted {
+		t.Fatalf("reset: got error: %v; want: %v", err, ErrNotStarted)
+	}
+	i = New(WithTTL(10 * time.Millisecond))
+	i.Do(ctx, func() (interface{}, error) { return nil, fail })
+	i.Do(ctx, func() (interface{}, error) { return "ok", nil })
+	time.Sleep(20 * time.Millisecond)
+	if _, err := i.GetOrExplain(ctx); err != ErrNotStarted {
+		t.Fatalf("expired: got error: %v; want: %v", err, ErrNotStarted)
+	}
+}
+
+func TestInitRunCount(t *testing.T) {
+	i := new(Init)
+	ctx := context.Background()
+	fail := errors.New("fail")
+	for k := 1; k <= 3; k++ {
+		i.Do(ctx, func() (interface{}, error) { return nil, fail })
+		if n := i.RunCount(); n != uint64(k) {
+			t.Fatalf("after %d failures: got run count %d; want: %d", k, n, k)
+		}
+	}
+	for k := 0; k < 3; k++ {
+		i.Do(ctx, func() (interface{}, error) { return "ok", nil })
+	}
+	if n := i.RunCount(); n != 4 {
+		t.Fatalf("after success: got run count %d; want: 4", n)
+	}
+}
+
+func TestInitSharedError(t *testing.T) {
+	const N = 10
+	i := new(Init)
+	ctx := context.Background()
+	release := make(chan struct{})
+	fn := func() (interface{}, error) {
+		<-release
+		return nil, errors.New("fail") // distinct instance per call
+	}
+	errc := make(chan error, N)
+	for k := 0; k < N; k++ {
+		go func() {
+			_, err := i.Do(ctx, fn)
+			errc <- err
+		}()
+	}
+	for atomic.LoadInt32(&i.waiters) < N {
+		runtime.Gosched()
+	}
+	close(release)
+	first := <-errc
+	for k := 1; k < N; k++ {
+		if err := <-errc; err != first {
+			t.Fatalf("got distinct errors: %p and %p; want identical", err, first)
+		}
+	}
+}
+
+// TestInitPublication checks that a value observed through the fast path is
+// fully published. Run it with -race to detect a missing happens-before edge.
+func TestInitPublication(t *testing.T) {
+	const (
+		iterations = 1000
+		readers    = 4
+	)
+	type value struct{ n, m int }
+	ctx := context.Background()
+	for k := 0; k < iterations; k++ {
+		i := new(Init)
+		var wg sync.WaitGroup
+		wg.Add(readers)
+		for r := 0; r < readers; r++ {
+			go func() {
+				defer wg.Done()
+				for {
+					val, err := i.GetOrExplain(ctx)
+					if err != nil {
+						runtime.Gosched()
+						continue
+					}
+					if v := val.(*value); v.n != k || v.m != -k {
+						t.Errorf("iteration %d: observed partially published value %+v", k, *v)
+					}
+					return
+				}
+			}()
+		}
+		i.Do(ctx, func() (interface{}, error) {
+			v := new(value)
+			v.n, v.m = k, -k
+			return v, nil
+		})
+		wg.Wait()
+	}
+}
+
+func BenchmarkCancelWaiters(b *testing.B) {
+	const N = 1000
+	b.ReportAllocs()
+	release := make(chan struct{})
+	defer close(release)
+	fn := func() (interface{}, error) {
+		<-release
+		return nil, nil
+	}
+	for k := 0; k < b.N; k++ {
+		b.StopTimer()
+		i := new(Init)
+		ctx, cancel := context.WithCancel(context.Background())
+		var wg sync.WaitGroup
+		wg.Add(N)
+		for j := 0; j < N; j++ {
+			go func() {
+				defer wg.Done()
+				i.Do(ctx, fn)
+			}()
+		}
+		for atomic.LoadInt32(&i.waiters) < N {
+			runtime.Gosched()
+		}
+		b.StartTimer()
+		cancel()
+		wg.Wait()
+	}
+}
+
+// BenchmarkDoContended measures the slow path under contention: fn always
+// fails, so every call to Do either starts a run or joins one.
+func BenchmarkDoContended(b *testing.B) {
+	b.ReportAllocs()
+	i := new(Init)
+	ctx := context.Background()
+	fail := errors.New("fail")
+	fn := func() (interface{}, error) { return nil, fail }
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			i.Do(ctx, fn)
+		}
+	})
+}
+
+// BenchmarkDoJoin measures a caller that joins a run in flight and gives up,
+// which should not allocate. (Do itself allocates to adapt its fn.)
+func BenchmarkDoJoin(b *testing.B) {
+	b.ReportAllocs()
+	i, ctx, stop := joinable()
+	defer stop()
+	b.ResetTimer()
+	for k := 0; k < b.N; k++ {
+		i.DoContext(ctx, nil)
+	}
+}
+
+func TestInitJoinAllocs(t *testing.T) {
+	i, ctx, stop := joinable()
+	defer stop()
+	if n := testing.AllocsPerRun(100, func() { i.DoContext(ctx, nil) }); n != 0 {
+		t.Fatalf("got %v allocs per joining call; want: 0", n)
+	}
+}
+
+// joinable returns an Init with a run in flight and a canceled context, so
+// that calls to Do join the run and give up at once.
+func joinable() (*Init, context.Context, func()) {
+	i := new(Init)
+	release := make(chan struct{})
+	i.Start(context.Background(), func(context.Context) (interface{}, error) {
+		<-release
+		return nil, nil
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	return i, ctx, func() { close(release) }
+}
+
 func testFunc(t *testing.T, i *Init, desc string, ctx context.Context, val interface{}, err error, fn func() (interface{}, error)) {
 	const N = 10
 	type result struct {
@@ -67,3 +936,28 @@ func testFunc(t *testing.T, i *Init, desc string, ctx context.Context, val inter
 		}
 	}
 }
+
+func waitFor(t *testing.T, desc string, cond func() bool) {
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", desc)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestInitCopied(t *testing.T) {
+	i := new(Init)
+	i.TryGet() // first use; a run would race with the copy below
+
+	// Copy through reflection, which go vet's copylocks checker can't see.
+	c := new(Init)
+	reflect.ValueOf(c).Elem().Set(reflect.ValueOf(i).Elem())
+	defer func() {
+		if r := recover(); r != initCopied {
+			t.Fatalf("got panic: %v; want: %v", r, initCopied)
+		}
+	}()
+	c.TryGet()
+}
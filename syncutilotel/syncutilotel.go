@@ -0,0 +1,82 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package syncutilotel traces lazy initialization with OpenTelemetry.
+package syncutilotel
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/abursavich/syncutil"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// A Tracer traces the runs of an initialization function and the callers
+// waiting on them. Each call to the function runs inside a span with the
+// attempt number of its run, as reported by syncutil.Attempt, and its outcome
+// as attributes. Since the context passed to fn carries the values of the
+// caller that started the run, the span is a child of that caller's span.
+type Tracer struct {
+	tracer trace.Tracer
+	name   string
+	last   atomic.Value // trace.SpanContext of the last attempt
+}
+
+// New returns a Tracer that starts spans named name with tracer.
+func New(tracer trace.Tracer, name string) *Tracer {
+	return &Tracer{tracer: tracer, name: name}
+}
+
+// Wrap returns a function that calls fn inside a span.
+func (t *Tracer) Wrap(fn func(ctx context.Context) (interface{}, error)) func(ctx context.Context) (interface{}, error) {
+	return func(ctx context.Context) (interface{}, error) {
+		ctx, span := t.tracer.Start(ctx, t.name, trace.WithAttributes(
+			attribute.Int("syncutil.attempt", syncutil.Attempt(ctx)),
+		))
+		defer span.End()
+		t.last.Store(span.SpanContext())
+		val, err := fn(ctx)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			span.SetAttributes(attribute.String("syncutil.outcome", "error"))
+		} else {
+			span.SetAttributes(attribute.String("syncutil.outcome", "success"))
+		}
+		return val, err
+	}
+}
+
+// Do calls i.DoShared with fn wrapped by Wrap, and adds an event to the span
+// of ctx, if any, describing how long the caller waited and where the results
+// came from. If the caller joined a run started by another caller, the event
+// identifies the span of its latest attempt.
+func (t *Tracer) Do(ctx context.Context, i *syncutil.Init, fn func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	start := time.Now()
+	val, src, err := i.DoShared(ctx, t.Wrap(fn))
+	span := trace.SpanFromContext(ctx)
+	if !span.IsRecording() {
+		return val, err
+	}
+	attrs := []attribute.KeyValue{
+		attribute.String("syncutil.name", t.name),
+		attribute.String("syncutil.source", src.String()),
+		attribute.Int64("syncutil.wait_ns", int64(time.Since(start))),
+	}
+	if sc, ok := t.last.Load().(trace.SpanContext); ok && src == syncutil.SourceJoined {
+		attrs = append(attrs,
+			attribute.String("syncutil.attempt.trace_id", sc.TraceID().String()),
+			attribute.String("syncutil.attempt.span_id", sc.SpanID().String()),
+		)
+	}
+	if err != nil {
+		attrs = append(attrs, attribute.String("syncutil.error", err.Error()))
+	}
+	span.AddEvent("syncutil.wait", trace.WithAttributes(attrs...))
+	return val, err
+}
@@ -0,0 +1,68 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package syncutilotel
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/abursavich/syncutil"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracer(t *testing.T) {
+	sr := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr))
+	tr := New(tp.Tracer("test"), "init")
+	i := new(syncutil.Init)
+
+	ctx, caller := tp.Tracer("test").Start(context.Background(), "caller")
+	fail := errors.New("fail")
+	if _, err := tr.Do(ctx, i, func(context.Context) (interface{}, error) { return nil, fail }); err != fail {
+		t.Fatalf("failure: got error: %v; want: %v", err, fail)
+	}
+	if _, err := tr.Do(ctx, i, func(context.Context) (interface{}, error) { return "ok", nil }); err != nil {
+		t.Fatalf("success: got error: %v", err)
+	}
+	caller.End()
+
+	spans := sr.Ended()
+	if len(spans) != 3 {
+		t.Fatalf("got %d spans; want: 3", len(spans))
+	}
+	for k, outcome := range []string{"error", "success"} {
+		s := spans[k]
+		if s.Parent().SpanID() != caller.SpanContext().SpanID() {
+			t.Errorf("attempt %d: not a child of the caller's span", k+1)
+		}
+		attrs := make(map[attribute.Key]attribute.Value)
+		for _, kv := range s.Attributes() {
+			attrs[kv.Key] = kv.Value
+		}
+		if got := attrs["syncutil.attempt"].AsInt64(); got != int64(k+1) {
+			t.Errorf("attempt %d: got attempt attribute: %d", k+1, got)
+		}
+		if got := attrs["syncutil.outcome"].AsString(); got != outcome {
+			t.Errorf("attempt %d: got outcome: %q; want: %q", k+1, got, outcome)
+		}
+	}
+	if n := len(spans[2].Events()); n != 2 {
+		t.Fatalf("caller: got %d events; want: 2", n)
+	}
+
+	// Attempts are numbered per Init, not per Tracer.
+	if _, err := tr.Do(context.Background(), new(syncutil.Init), func(context.Context) (interface{}, error) { return "ok", nil }); err != nil {
+		t.Fatalf("other Init: got error: %v", err)
+	}
+	spans = sr.Ended()
+	for _, kv := range spans[len(spans)-1].Attributes() {
+		if kv.Key == "syncutil.attempt" && kv.Value.AsInt64() != 1 {
+			t.Errorf("other Init: got attempt attribute: %d; want: 1", kv.Value.AsInt64())
+		}
+	}
+}
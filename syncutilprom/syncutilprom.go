@@ -0,0 +1,121 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package syncutilprom exports metrics about syncutil.Init values to
+// Prometheus.
+package syncutilprom
+
+import (
+	"sync"
+	"time"
+
+	"github.com/abursavich/syncutil"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// A Collector is a prometheus.Collector that reports metrics about the
+// Init values created by its New method, labeled by their names:
+//
+//	<namespace>_init_attempts_total          calls to fn
+//	<namespace>_init_failures_total          failed runs
+//	<namespace>_init_waiters                 callers waiting on the run in flight
+//	<namespace>_init_finished                1 if results are memoized, else 0
+//	<namespace>_init_duration_seconds        histogram of run durations
+type Collector struct {
+	attempts *prometheus.Desc
+	waiters  *prometheus.Desc
+	finished *prometheus.Desc
+	failures *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+
+	mu    sync.Mutex
+	inits map[string]*syncutil.Init
+}
+
+// NewCollector returns a new Collector whose metric names are prefixed by
+// namespace, which may be empty.
+func NewCollector(namespace string) *Collector {
+	labels := []string{"name"}
+	return &Collector{
+		attempts: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "init", "attempts_total"),
+			"Number of calls to the initialization function.",
+			labels, nil,
+		),
+		waiters: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "init", "waiters"),
+			"Number of callers waiting on the initialization in flight.",
+			labels, nil,
+		),
+		finished: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "init", "finished"),
+			"Whether initialization results are memoized.",
+			labels, nil,
+		),
+		failures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "init",
+			Name:      "failures_total",
+			Help:      "Number of failed initialization runs.",
+		}, labels),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "init",
+			Name:      "duration_seconds",
+			Help:      "Duration of initialization runs.",
+			Buckets:   prometheus.ExponentialBuckets(0.001, 4, 10),
+		}, labels),
+		inits: make(map[string]*syncutil.Init),
+	}
+}
+
+// New returns a new Init configured with opts whose metrics are reported
+// under name, replacing any Init previously reported under that name.
+// The Collector observes runs with syncutil.WithHooks, after any hooks given
+// in opts.
+func (c *Collector) New(name string, opts ...syncutil.Option) *syncutil.Init {
+	failures := c.failures.WithLabelValues(name)
+	duration := c.duration.WithLabelValues(name)
+	opts = append(opts[:len(opts):len(opts)], syncutil.WithHooks(syncutil.Hooks{
+		OnSuccess: func(attempt int, d time.Duration) {
+			duration.Observe(d.Seconds())
+		},
+		OnError: func(attempt int, d time.Duration, err error) {
+			failures.Inc()
+			duration.Observe(d.Seconds())
+		},
+	}))
+	i := syncutil.New(opts...)
+	c.mu.Lock()
+	c.inits[name] = i
+	c.mu.Unlock()
+	return i
+}
+
+// Describe implements prometheus.Collector.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.attempts
+	ch <- c.waiters
+	ch <- c.finished
+	c.failures.Describe(ch)
+	c.duration.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for name, i := range c.inits {
+		s := i.Stats()
+		finished := 0.0
+		if s.Finished {
+			finished = 1
+		}
+		ch <- prometheus.MustNewConstMetric(c.attempts, prometheus.CounterValue, float64(s.Attempts), name)
+		ch <- prometheus.MustNewConstMetric(c.waiters, prometheus.GaugeValue, float64(s.Waiters), name)
+		ch <- prometheus.MustNewConstMetric(c.finished, prometheus.GaugeValue, finished, name)
+	}
+	c.failures.Collect(ch)
+	c.duration.Collect(ch)
+}
@@ -0,0 +1,72 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package syncutilprom
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/abursavich/syncutil"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestCollector(t *testing.T) {
+	c := NewCollector("test")
+	reg := prometheus.NewPedanticRegistry()
+	if err := reg.Register(c); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	var errs int
+	i := c.New("db", syncutil.WithHooks(syncutil.Hooks{
+		OnError: func(int, time.Duration, error) { errs++ },
+	}))
+	ctx := context.Background()
+	fail := errors.New("fail")
+	if _, err := i.Do(ctx, func() (interface{}, error) { return nil, fail }); err != fail {
+		t.Fatalf("failure: got error: %v; want: %v", err, fail)
+	}
+	if _, err := i.Do(ctx, func() (interface{}, error) { return "ok", nil }); err != nil {
+		t.Fatalf("success: got error: %v", err)
+	}
+
+	if errs != 1 {
+		t.Fatalf("caller's hooks: got %d errors; want: 1", errs)
+	}
+
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("gather: %v", err)
+	}
+	got := make(map[string]float64)
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			if l := m.GetLabel(); len(l) != 1 || l[0].GetValue() != "db" {
+				t.Fatalf("%s: got labels: %v; want: name=db", mf.GetName(), l)
+			}
+			switch {
+			case m.Counter != nil:
+				got[mf.GetName()] = m.GetCounter().GetValue()
+			case m.Gauge != nil:
+				got[mf.GetName()] = m.GetGauge().GetValue()
+			case m.Histogram != nil:
+				got[mf.GetName()] = float64(m.GetHistogram().GetSampleCount())
+			}
+		}
+	}
+	want := map[string]float64{
+		"test_init_attempts_total":   2,
+		"test_init_failures_total":   1,
+		"test_init_waiters":          0,
+		"test_init_finished":         1,
+		"test_init_duration_seconds": 2,
+	}
+	for name, v := range want {
+		if got[name] != v {
+			t.Errorf("%s: got %v; want: %v", name, got[name], v)
+		}
+	}
+}
@@ -0,0 +1,277 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package syncutil
+
+import (
+	"container/list"
+	"fmt"
+	"hash/maphash"
+	"math/rand"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A table maps keys to Inits. It is split into shards, each with its own
+// lock, so that calls with unrelated keys rarely contend. With
+// WithMaxEntries, the table counts its entries and, once it has too many,
+// evicts the least recently used entry among a few sampled shards.
+type table[K comparable] struct {
+	once   sync.Once
+	seed   maphash.Seed
+	shards []shard[K]
+
+	max   int          // bound on entries, or zero if unbounded
+	count atomic.Int64 // entries, if bounded
+}
+
+// evictionSamples is the number of shards with entries that are compared to
+// find the entry to evict. Sampling keeps an insertion from locking every
+// shard, at the cost of an approximate LRU order across shards.
+const evictionSamples = 4
+
+// epoch is the origin of the times of use of entries.
+var epoch = time.Now()
+
+type shard[K comparable] struct {
+	mu  sync.Mutex
+	m   map[K]*entry[K]
+	lru list.List // entries, most recently used first, if bounded
+
+	_ [64]byte // avoid false sharing between shards
+}
+
+type entry[K comparable] struct {
+	key  K
+	init *Init
+	elem *list.Element // nil if unbounded
+	used time.Duration // time of the last use since epoch, if bounded
+}
+
+// shard returns the shard of key, allocating the shards if necessary.
+func (t *table[K]) shard(cfg *config, key K) *shard[K] {
+	t.once.Do(func() {
+		t.seed = maphash.MakeSeed()
+		t.shards = make([]shard[K], numShards(cfg.shards))
+		t.max = cfg.maxEntries
+	})
+	if len(t.shards) == 1 {
+		return &t.shards[0]
+	}
+	h := maphash.Comparable(t.seed, key)
+	return &t.shards[h&uint64(len(t.shards)-1)]
+}
+
+// get returns the Init of key, creating it with cfg if necessary.
+func (t *table[K]) get(cfg *config, key K) *Init {
+	s := t.shard(cfg, key)
+	s.mu.Lock()
+	if e := s.m[key]; e != nil {
+		t.touch(s, e)
+		s.mu.Unlock()
+		return e.init
+	}
+	i := &Init{cfg: *cfg}
+	t.insert(s, key, i)
+	s.mu.Unlock()
+	t.added()
+	return i
+}
+
+// lookup returns the Init of key, or nil if there is none.
+func (t *table[K]) lookup(cfg *config, key K) *Init {
+	s := t.shard(cfg, key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := s.m[key]
+	if e == nil {
+		return nil
+	}
+	t.touch(s, e)
+	return e.init
+}
+
+// put sets the Init of key to i and returns the one it replaces, if any.
+func (t *table[K]) put(cfg *config, key K, i *Init) *Init {
+	s := t.shard(cfg, key)
+	s.mu.Lock()
+	if e := s.m[key]; e != nil {
+		old := e.init
+		e.init = i
+		keyed(i, key)
+		t.touch(s, e)
+		s.mu.Unlock()
+		return old
+	}
+	t.insert(s, key, i)
+	s.mu.Unlock()
+	t.added()
+	return nil
+}
+
+// add sets the Init of key to i unless it already has one, and reports
+// whether it did.
+func (t *table[K]) add(cfg *config, key K, i *Init) bool {
+	s := t.shard(cfg, key)
+	s.mu.Lock()
+	if s.m[key] != nil {
+		s.mu.Unlock()
+		return false
+	}
+	t.insert(s, key, i)
+	s.mu.Unlock()
+	t.added()
+	return true
+}
+
+// remove removes and returns the Init of key, or nil if there is none.
+func (t *table[K]) remove(cfg *config, key K) *Init {
+	s := t.shard(cfg, key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := s.m[key]
+	if e == nil {
+		return nil
+	}
+	t.delete(s, e)
+	return e.init
+}
+
+// removeIf removes the Init of key if it is i.
+func (t *table[K]) removeIf(cfg *config, key K, i *Init) {
+	s := t.shard(cfg, key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e := s.m[key]; e != nil && e.init == i {
+		t.delete(s, e)
+	}
+}
+
+// each calls fn for every key and its Init, without holding any locks.
+func (t *table[K]) each(fn func(key K, i *Init)) {
+	var entries []*entry[K]
+	for k := range t.shards {
+		s := &t.shards[k]
+		s.mu.Lock()
+		for _, e := range s.m {
+			entries = append(entries, e)
+		}
+		s.mu.Unlock()
+		for _, e := range entries {
+			fn(e.key, e.init)
+		}
+		entries = entries[:0]
+	}
+}
+
+// removeAll removes every Init and calls fn for each of them, without
+// holding any locks.
+func (t *table[K]) removeAll(fn func(*Init)) {
+	for k := range t.shards {
+		s := &t.shards[k]
+		s.mu.Lock()
+		m := s.m
+		s.m = nil
+		s.lru.Init()
+		if t.max > 0 {
+			t.count.Add(-int64(len(m)))
+		}
+		s.mu.Unlock()
+		for _, e := range m {
+			fn(e.init)
+		}
+	}
+}
+
+// insert adds i as the Init of key, which must not have one. s.mu must be
+// held, and t.added must be called once it is released.
+func (t *table[K]) insert(s *shard[K], key K, i *Init) {
+	if s.m == nil {
+		s.m = make(map[K]*entry[K])
+	}
+	e := &entry[K]{key: key, init: i}
+	s.m[key] = e
+	keyed(i, key)
+	if t.max > 0 {
+		e.elem = s.lru.PushFront(e)
+		e.used = time.Since(epoch)
+	}
+}
+
+// added counts an inserted entry and, if there are too many, evicts the
+// least recently used entry among a few shards, starting at a random one.
+// Its Init is dropped, so its value is passed to the finalizer, even if its
+// run is still in flight.
+func (t *table[K]) added() {
+	if t.max <= 0 || t.count.Add(1) <= int64(t.max) {
+		return
+	}
+	for {
+		var victim *shard[K]
+		var oldest *entry[K]
+		var used time.Duration // of oldest, when sampled
+		n := len(t.shards)
+		for k, seen := rand.Intn(n), 0; seen < evictionSamples && n > 0; k, n = k+1, n-1 {
+			s := &t.shards[k&(len(t.shards)-1)]
+			s.mu.Lock()
+			if b := s.lru.Back(); b != nil {
+				seen++
+				if e := b.Value.(*entry[K]); oldest == nil || e.used < used {
+					victim, oldest, used = s, e, e.used
+				}
+			}
+			s.mu.Unlock()
+		}
+		if victim == nil { // emptied meanwhile
+			return
+		}
+		victim.mu.Lock()
+		if b := victim.lru.Back(); b != nil && b.Value == oldest && oldest.used == used {
+			t.delete(victim, oldest)
+			victim.mu.Unlock()
+			oldest.init.drop()
+			return
+		}
+		victim.mu.Unlock() // used meanwhile; look again
+	}
+}
+
+// touch marks e as the most recently used entry. s.mu must be held.
+func (t *table[K]) touch(s *shard[K], e *entry[K]) {
+	if e.elem != nil {
+		s.lru.MoveToFront(e.elem)
+		e.used = time.Since(epoch)
+	}
+}
+
+// delete deletes the entry e. s.mu must be held.
+func (t *table[K]) delete(s *shard[K], e *entry[K]) {
+	delete(s.m, e.key)
+	if e.elem != nil {
+		s.lru.Remove(e.elem)
+		t.count.Add(-1)
+	}
+}
+
+// keyed sets the key that the run of i passes to its Locker, if it has one.
+func keyed[K comparable](i *Init, key K) {
+	if i.cfg.locker != nil {
+		i.lockKey = fmt.Sprint(key)
+	}
+}
+
+// numShards returns the number of shards to use: n rounded up to a power of
+// two or, if n is not positive, a default based on GOMAXPROCS.
+func numShards(n int) int {
+	if n <= 0 {
+		n = 4 * runtime.GOMAXPROCS(0)
+	}
+	p := 1
+	for p < n {
+		p <<= 1
+	}
+	return p
+}
@@ -0,0 +1,139 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package syncutil
+
+import (
+	"context"
+	"fmt"
+)
+
+// TypedInit is like Init, but memoizes a value of type T, sparing callers a
+// type assertion. The zero value is ready to use with the default options.
+type TypedInit[T any] struct {
+	init Init
+}
+
+// NewTypedInit returns a TypedInit configured with the given options.
+// A value given to WithColdStartDefault must be of type T.
+func NewTypedInit[T any](opts ...Option) *TypedInit[T] {
+	t := new(TypedInit[T])
+	t.init.cfg.apply(opts)
+	return t
+}
+
+// Do is like Init.Do, but fn returns a value of type T.
+func (t *TypedInit[T]) Do(ctx context.Context, fn func() (T, error)) (T, error) {
+	v, err := t.init.Do(ctx, func() (interface{}, error) {
+		return fn()
+	})
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+	val, _ := v.(T) // a nil interface value is the zero T
+	return val, nil
+}
+
+// MustDo is like Init.MustDo, but fn returns a value of type T.
+func (t *TypedInit[T]) MustDo(ctx context.Context, fn func() (T, error)) T {
+	val, err := t.Do(ctx, fn)
+	if err != nil {
+		panic(fmt.Errorf("syncutil: MustDo: %w", err))
+	}
+	return val
+}
+
+// TryGet is like Init.TryGet.
+func (t *TypedInit[T]) TryGet() (T, bool) {
+	v, ok := t.init.TryGet()
+	val, _ := v.(T)
+	return val, ok
+}
+
+// Done is like Init.Done.
+func (t *TypedInit[T]) Done() <-chan struct{} {
+	return t.init.Done()
+}
+
+// Reset is like Init.Reset.
+func (t *TypedInit[T]) Reset() {
+	t.init.Reset()
+}
+
+// A Lazy is a value of type T computed by a function on first use, for
+// callers without a context. It sits between sync.OnceValue, which never
+// retries, and TypedInit: concurrent calls to Get share a single call to fn,
+// a failure is returned to them and retried by later calls, and the first
+// success is memoized.
+type Lazy[T any] struct {
+	fn   func() (T, error)
+	init TypedInit[T]
+}
+
+// NewLazy returns a Lazy that computes its value with fn, configured with
+// the given options, as with NewTypedInit.
+func NewLazy[T any](fn func() (T, error), opts ...Option) *Lazy[T] {
+	l := &Lazy[T]{fn: fn}
+	l.init.init.cfg.apply(opts)
+	return l
+}
+
+// Get returns the value of l, computing it if necessary. It blocks until
+// the call to fn in flight, if any, is over.
+func (l *Lazy[T]) Get() (T, error) {
+	return l.init.Do(context.Background(), l.fn)
+}
+
+// LazyFunc returns a function that calls build to construct a function the
+// first time it is needed, and then applies the constructed function to each
+// input. Concurrent callers share a single call to build, and a failed build
+// is retried by later callers, as with Init.Do.
+func LazyFunc[In, Out any](build func() (func(In) Out, error)) func(context.Context, In) (Out, error) {
+	i := new(Init)
+	return func(ctx context.Context, in In) (Out, error) {
+		f, err := i.Do(ctx, func() (interface{}, error) {
+			return build()
+		})
+		if err != nil {
+			var zero Out
+			return zero, err
+		}
+		return f.(func(In) Out)(in), nil
+	}
+}
+
+// Init2 is like Init, but memoizes a pair of typed values, in the manner of
+// sync.OnceValues. The zero value is ready to use.
+type Init2[A, B any] struct {
+	init Init
+}
+
+type pair[A, B any] struct {
+	a A
+	b B
+}
+
+// Do is like Init.Do, but fn returns a pair of values.
+func (i *Init2[A, B]) Do(ctx context.Context, fn func() (A, B, error)) (A, B, error) {
+	v, err := i.init.Do(ctx, func() (interface{}, error) {
+		a, b, err := fn()
+		if err != nil {
+			return nil, err
+		}
+		return pair[A, B]{a, b}, nil
+	})
+	if err != nil {
+		var a A
+		var b B
+		return a, b, err
+	}
+	p := v.(pair[A, B])
+	return p.a, p.b, nil
+}
+
+// Reset is like Init.Reset.
+func (i *Init2[A, B]) Reset() {
+	i.init.Reset()
+}
@@ -0,0 +1,171 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package syncutil
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTypedInit(t *testing.T) {
+	var i TypedInit[*url.URL]
+	ctx := context.Background()
+	fail := errors.New("fail")
+	if u, err := i.Do(ctx, func() (*url.URL, error) {
+		return nil, fail
+	}); u != nil || err != fail {
+		t.Fatalf("failure: got: (%v, %v); want: (<nil>, %v)", u, err, fail)
+	}
+	var runs uint32
+	u, err := i.Do(ctx, func() (*url.URL, error) {
+		atomic.AddUint32(&runs, 1)
+		return url.Parse("https://example.com")
+	})
+	if err != nil || u.Host != "example.com" {
+		t.Fatalf("success: got: (%v, %v); want: (https://example.com, <nil>)", u, err)
+	}
+	if u2, _ := i.Do(ctx, func() (*url.URL, error) {
+		atomic.AddUint32(&runs, 1)
+		return nil, nil
+	}); u2 != u {
+		t.Fatalf("memoized: got: %v; want: %v", u2, u)
+	}
+	if n := atomic.LoadUint32(&runs); n != 1 {
+		t.Fatalf("fn ran %d times; want: 1", n)
+	}
+	if got, ok := i.TryGet(); got != u || !ok {
+		t.Fatalf("TryGet: got: (%v, %v); want: (%v, true)", got, ok, u)
+	}
+	if got := i.MustDo(ctx, nil); got != u {
+		t.Fatalf("MustDo: got: %v; want: %v", got, u)
+	}
+
+	// A nil interface value is memoized as the zero value.
+	var r TypedInit[io.Reader]
+	if got, err := r.Do(ctx, func() (io.Reader, error) {
+		return nil, nil
+	}); got != nil || err != nil {
+		t.Fatalf("nil interface: got: (%v, %v); want: (<nil>, <nil>)", got, err)
+	}
+
+	s := NewTypedInit[string](WithColdStartDefault("default"))
+	release := make(chan struct{})
+	defer close(release)
+	if got, err := s.Do(ctx, func() (string, error) {
+		<-release
+		return "real", nil
+	}); got != "default" || err != nil {
+		t.Fatalf("cold start: got: (%v, %v); want: (default, <nil>)", got, err)
+	}
+}
+
+func TestLazy(t *testing.T) {
+	var runs uint32
+	fail := errors.New("fail")
+	l := NewLazy(func() (int, error) {
+		if atomic.AddUint32(&runs, 1) == 1 {
+			return 0, fail
+		}
+		time.Sleep(10 * time.Millisecond)
+		return 42, nil
+	})
+	if v, err := l.Get(); v != 0 || err != fail {
+		t.Fatalf("failure: got: (%v, %v); want: (0, %v)", v, err, fail)
+	}
+	const N = 10
+	errc := make(chan error, N)
+	for k := 0; k < N; k++ {
+		go func() {
+			v, err := l.Get()
+			if err == nil && v != 42 {
+				t.Errorf("got: %v; want: 42", v)
+			}
+			errc <- err
+		}()
+	}
+	for k := 0; k < N; k++ {
+		if err := <-errc; err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+	}
+	if n := atomic.LoadUint32(&runs); n != 2 {
+		t.Fatalf("fn ran %d times; want: 2", n)
+	}
+}
+
+func TestLazyFunc(t *testing.T) {
+	var builds uint32
+	upper := LazyFunc(func() (func(string) string, error) {
+		atomic.AddUint32(&builds, 1)
+		time.Sleep(10 * time.Millisecond)
+		return strings.ToUpper, nil
+	})
+	const N = 10
+	ctx := context.Background()
+	errc := make(chan error, N)
+	for k := 0; k < N; k++ {
+		go func() {
+			out, err := upper(ctx, "abc")
+			if err == nil && out != "ABC" {
+				t.Errorf("got: %q; want: %q", out, "ABC")
+			}
+			errc <- err
+		}()
+	}
+	for k := 0; k < N; k++ {
+		if err := <-errc; err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+	}
+	if out, err := upper(ctx, "xyz"); out != "XYZ" || err != nil {
+		t.Fatalf("got: (%q, %v); want: (XYZ, <nil>)", out, err)
+	}
+	if n := atomic.LoadUint32(&builds); n != 1 {
+		t.Fatalf("build ran %d times; want: 1", n)
+	}
+}
+
+func TestInit2(t *testing.T) {
+	var i Init2[*url.URL, int]
+	var runs uint32
+	fn := func() (*url.URL, int, error) {
+		atomic.AddUint32(&runs, 1)
+		time.Sleep(10 * time.Millisecond)
+		u, err := url.Parse("https://example.com")
+		return u, 42, err
+	}
+	const N = 10
+	ctx := context.Background()
+	type result struct {
+		u   *url.URL
+		n   int
+		err error
+	}
+	ch := make(chan result, N)
+	for k := 0; k < N; k++ {
+		go func() {
+			u, n, err := i.Do(ctx, fn)
+			ch <- result{u, n, err}
+		}()
+	}
+	first := <-ch
+	if first.err != nil || first.u.Host != "example.com" || first.n != 42 {
+		t.Fatalf("got: (%v, %v, %v); want: (https://example.com, 42, <nil>)", first.u, first.n, first.err)
+	}
+	for k := 1; k < N; k++ {
+		if r := <-ch; r != first {
+			t.Fatalf("got: (%v, %v, %v); want: (%v, %v, %v)", r.u, r.n, r.err, first.u, first.n, first.err)
+		}
+	}
+	if n := atomic.LoadUint32(&runs); n != 1 {
+		t.Fatalf("fn ran %d times; want: 1", n)
+	}
+}
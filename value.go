@@ -0,0 +1,76 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package syncutil
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// A Value is a value of type T completed by a producer, such as
+// configuration pushed by a control plane, rather than computed by a
+// function: consumers wait for it with Get, and the producer completes it
+// exactly once with Set or Fail. The zero value is ready to use.
+type Value[T any] struct {
+	noCopy noCopy
+
+	once sync.Once
+	done chan struct{} // closed once val and err are set
+	set  atomic.Bool   // set once the first Set or Fail wins
+	val  T
+	err  error
+}
+
+func (v *Value[T]) init() {
+	v.once.Do(func() { v.done = make(chan struct{}) })
+}
+
+// Set completes v with val and reports whether it did: only the first call
+// to Set or Fail completes v, and later calls have no effect.
+func (v *Value[T]) Set(val T) bool {
+	return v.complete(val, nil)
+}
+
+// Fail completes v with err, like Set: Get returns err to all consumers.
+func (v *Value[T]) Fail(err error) bool {
+	var zero T
+	return v.complete(zero, err)
+}
+
+func (v *Value[T]) complete(val T, err error) bool {
+	v.init()
+	if !v.set.CompareAndSwap(false, true) {
+		return false
+	}
+	v.val, v.err = val, err
+	close(v.done)
+	return true
+}
+
+// Get waits for v to be completed and returns its value or error. If ctx is
+// done first, it returns the cause of ctx, as reported by context.Cause. As
+// with Init.Do, a completed value takes precedence over ctx.
+func (v *Value[T]) Get(ctx context.Context) (T, error) {
+	v.init()
+	select {
+	case <-v.done:
+		return v.val, v.err
+	default:
+	}
+	select {
+	case <-v.done:
+		return v.val, v.err
+	case <-ctx.Done():
+		var zero T
+		return zero, context.Cause(ctx)
+	}
+}
+
+// Done returns a channel that is closed once v is completed.
+func (v *Value[T]) Done() <-chan struct{} {
+	v.init()
+	return v.done
+}
@@ -0,0 +1,57 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package syncutil
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestValue(t *testing.T) {
+	const N = 10
+	var v Value[string]
+	ctx := context.Background()
+	wctx, cancel := context.WithTimeout(ctx, time.Millisecond)
+	defer cancel()
+	if got, err := v.Get(wctx); got != "" || err != context.DeadlineExceeded {
+		t.Fatalf("before Set: got: (%q, %v); want: (\"\", %v)", got, err, context.DeadlineExceeded)
+	}
+	errc := make(chan error, N)
+	for k := 0; k < N; k++ {
+		go func() {
+			got, err := v.Get(ctx)
+			if err == nil && got != "config" {
+				t.Errorf("got: %q; want: config", got)
+			}
+			errc <- err
+		}()
+	}
+	if !v.Set("config") {
+		t.Fatal("Set: got false; want: true")
+	}
+	for k := 0; k < N; k++ {
+		if err := <-errc; err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+	}
+	if v.Set("other") || v.Fail(errors.New("fail")) {
+		t.Fatal("completed twice")
+	}
+	<-v.Done()
+	if got, err := v.Get(wctx); got != "config" || err != nil {
+		t.Fatalf("after Set: got: (%q, %v); want: (config, <nil>)", got, err)
+	}
+
+	var f Value[int]
+	fail := errors.New("fail")
+	if !f.Fail(fail) {
+		t.Fatal("Fail: got false; want: true")
+	}
+	if got, err := f.Get(ctx); got != 0 || err != fail {
+		t.Fatalf("after Fail: got: (%v, %v); want: (0, %v)", got, err, fail)
+	}
+}
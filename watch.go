@@ -0,0 +1,61 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package syncutil
+
+import "context"
+
+// Watch returns a channel that delivers each value memoized by i from now
+// on, starting with the current one, if any, so that callers can react when
+// a refresh or a run after a reset or expiration swaps in a new value, such
+// as a rotated certificate, instead of polling. Errors are not delivered.
+//
+// The channel holds a single value: a watcher that falls behind misses
+// intermediate values and receives the latest one. It is closed once ctx is
+// done or i is canceled. Watch does not start a run.
+func (i *Init) Watch(ctx context.Context) <-chan interface{} {
+	ch := make(chan interface{}, 1)
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.canceled != nil {
+		close(ch)
+		return ch
+	}
+	if g := i.load(); g != nil && g.err == nil {
+		ch <- g.val
+	}
+	if i.watchers == nil {
+		i.watchers = make(map[chan interface{}]struct{})
+	}
+	i.watchers[ch] = struct{}{}
+	context.AfterFunc(ctx, func() {
+		i.mu.Lock()
+		defer i.mu.Unlock()
+		if _, ok := i.watchers[ch]; ok {
+			delete(i.watchers, ch)
+			close(ch)
+		}
+	})
+	return ch
+}
+
+// notify delivers val to the watchers of i, replacing any value they have
+// not received yet. i.mu must be held.
+func (i *Init) notify(val interface{}) {
+	for ch := range i.watchers {
+		select {
+		case <-ch: // drop the stale value
+		default:
+		}
+		ch <- val // cannot block: i.mu is held and ch is empty
+	}
+}
+
+// unwatch closes the channels of the watchers of i. i.mu must be held.
+func (i *Init) unwatch() {
+	for ch := range i.watchers {
+		close(ch)
+	}
+	i.watchers = nil
+}
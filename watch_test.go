@@ -0,0 +1,60 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package syncutil
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestWatch(t *testing.T) {
+	i := new(Init)
+	ctx := context.Background()
+	wctx, cancel := context.WithCancel(ctx)
+	w := i.Watch(wctx)
+	val := func(v string) func() (interface{}, error) {
+		return func() (interface{}, error) { return v, nil }
+	}
+	recv := func(desc string, want interface{}) {
+		t.Helper()
+		select {
+		case got := <-w:
+			if got != want {
+				t.Fatalf("%s: got: %v; want: %v", desc, got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s: no value delivered", desc)
+		}
+	}
+
+	testFunc(t, i, "first", ctx, "v1", nil, val("v1"))
+	recv("first", "v1")
+	i.Reset()
+	i.Do(ctx, func() (interface{}, error) { return nil, errors.New("fail") })
+	testFunc(t, i, "second", ctx, "v2", nil, val("v2"))
+	i.Reset()
+	testFunc(t, i, "third", ctx, "v3", nil, val("v3"))
+	recv("behind", "v3") // v2 was replaced; the error was not delivered
+
+	// A new watcher starts with the current value.
+	w2 := i.Watch(ctx)
+	if got := <-w2; got != "v3" {
+		t.Fatalf("current: got: %v; want: v3", got)
+	}
+
+	cancel()
+	if _, ok := <-w; ok {
+		t.Fatal("ctx done: channel not closed")
+	}
+	i.Cancel(nil)
+	if _, ok := <-w2; ok {
+		t.Fatal("canceled: channel not closed")
+	}
+	if _, ok := <-i.Watch(ctx); ok {
+		t.Fatal("Watch after Cancel: channel not closed")
+	}
+}